@@ -8,6 +8,7 @@ import (
 	"os"
 
 	"github.com/leryn1122/csi-s3/pkg/driver"
+	"github.com/leryn1122/csi-s3/pkg/mounter"
 )
 
 func init() {
@@ -18,24 +19,34 @@ func init() {
 }
 
 var (
-	endpoint = flag.String("endpoint", "unix://csi/csi.sock", "CSI Endpoint")
-	nodeID   = flag.String("nodeid", "", "Node ID")
+	endpoint    = flag.String("endpoint", "unix://csi/csi.sock", "CSI Endpoint")
+	nodeID      = flag.String("nodeid", "", "Node ID")
+	mode        = flag.String("mode", driver.ModeAll, "Services to serve: controller, node or all")
+	launcher    = flag.String("fuse-launcher", mounter.LauncherDirect, "Launcher of the FUSE processes: direct or systemd-run")
+	ambient     = flag.Bool("ambient-credentials-in-secrets", false, "Accept the credential providers env, imds, file and webIdentity from the secrets, which must then only be writable by the admins")
+	listVolumes = flag.Bool("list-volumes", false, "Advertise ListVolumes and ControllerGetVolume, which only cover the buckets seen since the controller started")
+	showVersion = flag.Bool("version", false, "Show version.")
 )
 
 func main() {
 	flag.Parse()
 
 	// Fast quick if show version.
-	showVersion := flag.Bool("version", false, "Show version.")
 	if *showVersion {
 		fmt.Println(support.Version)
 		return
 	}
 
-	s3driver, err := driver.NewDriver(*nodeID, *endpoint)
+	if err := mounter.SetLauncher(*launcher); err != nil {
+		log.Fatal(err)
+	}
+
+	s3driver, err := driver.NewDriver(*nodeID, *endpoint, *mode)
 	if err != nil {
 		log.Fatal(err)
 	}
+	s3driver.Config.AmbientCredentialsInSecrets = *ambient
+	s3driver.Config.ListVolumes = *listVolumes
 
 	if err := s3driver.Run(); err != nil {
 		fmt.Printf("Failed to run driver: %s", err.Error())
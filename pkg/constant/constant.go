@@ -1,6 +1,51 @@
 package constant
 
 const (
-	TypeKey   = "mounter"
-	BucketKey = "bucket"
+	TypeKey             = "mounter"
+	BucketKey           = "bucket"
+	OnDeleteKey         = "onDelete"
+	ProvisioningModeKey = "provisioningMode"
+	BasePrefixKey       = "basePrefix"
+	BucketTemplateKey   = "bucketNameTemplate"
+	AddressingStyleKey  = "addressingStyle"
 )
+
+// TLS settings of the endpoint, given by the secrets or the volume parameters,
+// except for the client certificate which only lives in the secrets.
+const (
+	CABundleKey = "caBundle"
+	// CABundleConfigMapKey refers to the CA bundle in a ConfigMap as
+	// `<namespace>/<name>[/<key>]`, where the key defaults to `ca.crt`.
+	CABundleConfigMapKey  = "caBundleConfigMap"
+	InsecureSkipVerifyKey = "insecureSkipVerify"
+	TLSClientCertKey      = "tlsClientCert"
+	TLSClientKeyKey       = "tlsClientKey"
+)
+
+// SessionTokenKey is the session token of the temporary keys of the secrets.
+const SessionTokenKey = "sessionToken"
+
+// Credential providers beyond the static keys, see s3.CredentialsConfig. The
+// LDAP account only lives in the secrets, while the others may also be given
+// by the parameters.
+const (
+	CredentialProviderKey   = "credentialProvider"
+	CredentialsPathKey      = "credentialsPath"
+	RoleARNKey              = "roleArn"
+	RoleSessionNameKey      = "roleSessionName"
+	ExternalIDKey           = "externalId"
+	STSEndpointKey          = "stsEndpoint"
+	WebIdentityTokenFileKey = "webIdentityTokenFile"
+	LDAPUsernameKey         = "ldapUsername"
+	LDAPPasswordKey         = "ldapPassword"
+)
+
+// Parameters added by the external-provisioner with `--extra-create-metadata`.
+const (
+	PVCNameKey      = "csi.storage.k8s.io/pvc/name"
+	PVCNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	PVNameKey       = "csi.storage.k8s.io/pv/name"
+)
+
+// PluginDir is the directory owned by the driver on the node.
+const PluginDir = "/var/lib/kubelet/plugins/io.github.leryn.csi.s3driver"
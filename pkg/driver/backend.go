@@ -0,0 +1,30 @@
+package driver
+
+import (
+	"github.com/leryn1122/csi-s3/pkg/constant"
+)
+
+// addBackend remembers the secrets of the bucket, so that the RPCs without any
+// secret in the request, e.g. ListVolumes, are able to reach the bucket.
+func (d *CSIS3Driver) addBackend(bucket string, secrets map[string]string) {
+	backend := make(map[string]string, len(secrets)+1)
+	for key, value := range secrets {
+		backend[key] = value
+	}
+	backend[constant.BucketKey] = bucket
+
+	d.Lock()
+	defer d.Unlock()
+	d.backends[secrets["endpoint"]+"/"+bucket] = backend
+}
+
+// listBackends returns the secrets of the buckets seen so far.
+func (d *CSIS3Driver) listBackends() []map[string]string {
+	d.Lock()
+	defer d.Unlock()
+	backends := make([]map[string]string, 0, len(d.backends))
+	for _, backend := range d.backends {
+		backends = append(backends, backend)
+	}
+	return backends
+}
@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/leryn1122/csi-s3/pkg/mounter"
+	"k8s.io/klog/v2"
+)
+
+// isReadOnlyAccessMode reports whether the access mode never writes the volume.
+func isReadOnlyAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// validateVolumeCapability returns why the volume capability is not supported,
+// or nil if it is. The bucket is only mounted as a filesystem.
+func (d *CSIS3Driver) validateVolumeCapability(capability *csi.VolumeCapability) error {
+	if capability.GetBlock() != nil {
+		return errors.New("block access is not supported")
+	}
+	if capability.GetMount() == nil {
+		return errors.New("mount access type must be provided")
+	}
+	mode := capability.GetAccessMode().GetMode()
+	for _, supported := range d.Driver.GetVolumeCapabilityAccessModes() {
+		if supported.GetMode() == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("access mode %s is not supported", mode)
+}
+
+func (d *CSIS3Driver) validateVolumeCapabilities(capabilities []*csi.VolumeCapability) error {
+	for _, capability := range capabilities {
+		if err := d.validateVolumeCapability(capability); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateMounterCapabilities returns why the mounter does not support one of
+// the volume capabilities, with their mount options, or nil if it does. The
+// access modes without any consistency guarantee are accepted with a warning.
+func validateMounterCapabilities(mounterType string, parameters map[string]string, capabilities []*csi.VolumeCapability) error {
+	for _, capability := range capabilities {
+		options := mounter.VolumeOptions{
+			Parameters: parameters,
+			MountFlags: capability.GetMount().GetMountFlags(),
+		}
+		if err := mounter.ValidateOptions(mounterType, options); err != nil {
+			return err
+		}
+		mode := capability.GetAccessMode().GetMode()
+		switch mounter.AccessModeSupportOf(mounterType, options, mode) {
+		case mounter.AccessModeUnsupported:
+			return fmt.Errorf("access mode %s is not supported by mounter %s", mode, mounterType)
+		case mounter.AccessModeUnsafe:
+			klog.Warningf("Access mode %s of mounter %s has no consistency guarantee, writers on different nodes may overwrite the changes of each other", mode, mounterType)
+		}
+	}
+	return nil
+}
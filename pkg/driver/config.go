@@ -6,16 +6,43 @@ const (
 	DriverName = "io.github.leryn.csi.s3driver"
 )
 
+// Modes of the driver, which decide the gRPC services to serve.
+const (
+	ModeController = "controller"
+	ModeNode       = "node"
+	ModeAll        = "all"
+)
+
 type Config struct {
 	DriverName string
 	Version    string
 	NodeID     string
 	Endpoint   string
+	Mode       string
+	// AmbientCredentialsInSecrets accepts the ambient credential providers
+	// from the secrets, which are otherwise only accepted from the parameters
+	// of the StorageClass, as the secrets may belong to the users.
+	AmbientCredentialsInSecrets bool
+	// ListVolumes advertises ListVolumes and ControllerGetVolume, which only
+	// reach the buckets seen since the controller started, as the requests
+	// carry no secret.
+	ListVolumes bool
+}
+
+// IsController reports whether the controller service is served.
+func (c *Config) IsController() bool {
+	return c.Mode == ModeController || c.Mode == ModeAll
+}
+
+// IsNode reports whether the node service is served.
+func (c *Config) IsNode() bool {
+	return c.Mode == ModeNode || c.Mode == ModeAll
 }
 
 func NewConfig() Config {
 	return Config{
 		DriverName: DriverName,
 		Version:    support.Version,
+		Mode:       ModeAll,
 	}
 }
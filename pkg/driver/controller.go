@@ -4,45 +4,158 @@ import (
 	"context"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	mapset "github.com/deckarep/golang-set"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/inhies/go-bytesize"
 	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/leryn1122/csi-s3/pkg/mounter"
 	"github.com/leryn1122/csi-s3/pkg/s3"
+	"github.com/leryn1122/csi-s3/pkg/volume"
 	"github.com/mariomac/gostream/stream"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/klog/v2"
-	"net/http"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Reclaim policies of the volume data on DeleteVolume, given by the `onDelete`
+// parameter of the StorageClass.
+const (
+	onDeleteRetain       = "retain"
+	onDeleteDeletePrefix = "deletePrefix"
+	onDeleteDeleteBucket = "deleteBucket"
+	onDeleteArchive      = "archive"
+)
+
+// archivePrefix is where the archived volumes are moved to.
+const archivePrefix = "csi-archive"
+
+// Provisioning modes given by the `provisioningMode` parameter. A shared volume
+// takes the whole bucket, while a volume with a prefix per volume takes the
+// `<basePrefix>/<name>` of the bucket, so that many volumes share one bucket.
+// A volume with a bucket per volume creates its dedicated bucket named after
+// the `bucketNameTemplate`.
+const (
+	provisioningModeShared = "shared"
+	provisioningModePrefix = "prefix"
+	provisioningModeBucket = "bucket"
+)
+
+// defaultBasePrefix is the base prefix of the volumes with a prefix per volume.
+const defaultBasePrefix = "csi-fs"
+
 func (d *CSIS3Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	if err := d.validateControllerServiceRequestCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		return nil, err
 	}
 
-	volumeId := request.GetName()
-	if len(volumeId) == 0 {
+	name := request.GetName()
+	if len(name) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume name must be provided")
 	}
 	capabilities := request.GetVolumeCapabilities()
 	if capabilities == nil || len(capabilities) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume capabilities must be provided")
 	}
+	if err := d.validateVolumeCapabilities(capabilities); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	parameters := request.GetParameters()
+	secrets, err := d.requestSecrets(ctx, request.GetSecrets(), parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	config, err := s3.ConfigFromSecrets(secrets)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The mounter is a volume preference, but is still accepted from secrets.
+	mounterType := parameters[constant.TypeKey]
+	if len(mounterType) == 0 {
+		mounterType = secrets[constant.TypeKey]
+	}
+	bucket := parameters[constant.BucketKey]
+	if len(bucket) == 0 {
+		bucket = secrets[constant.BucketKey]
+	}
 
-	secrets := request.GetSecrets()
-	mounterType := secrets[constant.TypeKey]
-	bucket := secrets[constant.BucketKey]
+	onDelete := parameters[constant.OnDeleteKey]
+	switch onDelete {
+	case "":
+		onDelete = onDeleteRetain
+	case onDeleteRetain, onDeleteDeletePrefix, onDeleteDeleteBucket, onDeleteArchive:
+	default:
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown reclaim policy %s: %s", constant.OnDeleteKey, onDelete))
+	}
+
+	// The volume of the whole bucket is identified by its name, while the one
+	// with a prefix per volume encodes the bucket and the prefix into its ID.
+	var prefix string
+	var dedicated bool
+	mode := parameters[constant.ProvisioningModeKey]
+	switch mode {
+	case "", provisioningModeShared:
+	case provisioningModeBucket:
+		if bucket, err = renderBucketName(parameters[constant.BucketTemplateKey], name, parameters); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("failed to render bucket name: %s", err.Error()))
+		}
+		if err = s3.ValidateBucketName(bucket); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		dedicated = true
+	case provisioningModePrefix:
+		basePrefix := strings.Trim(parameters[constant.BasePrefixKey], "/")
+		if len(basePrefix) == 0 {
+			basePrefix = defaultBasePrefix
+		}
+		// The metadata of the volumes lives under its own prefix, which must
+		// not be mounted.
+		if basePrefix != path.Clean(basePrefix) || strings.HasPrefix(basePrefix, "..") ||
+			basePrefix == s3.MetadataPrefix || strings.HasPrefix(basePrefix, s3.MetadataPrefix+"/") {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s: %s", constant.BasePrefixKey, basePrefix))
+		}
+		prefix = path.Join(basePrefix, prefixName(name))
+	default:
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown %s: %s", constant.ProvisioningModeKey, mode))
+	}
+	if err := validateOnDelete(onDelete, mode); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	if len(bucket) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "bucket name count not be empty")
 	}
+	effectiveMounter := mounterType
+	if len(effectiveMounter) == 0 {
+		effectiveMounter = mounter.S3fsMounterType
+	}
+	if err := validateMounterCapabilities(effectiveMounter, parameters, capabilities); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := mounter.ValidateTLS(effectiveMounter, config.TLS); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The provisioner secret is only used by the driver, e.g. with the ldap
+	// provider, while the mounters take the node-stage secret. Only the provider
+	// given by the parameters applies to both.
+	if _, ok := parameters[constant.CredentialProviderKey]; ok {
+		if err := mounter.ValidateCredentials(effectiveMounter, config); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if err := mounter.ValidateSessionToken(effectiveMounter, config); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	id, err := volume.New(mounterType, bucket, prefix, prefixName(name))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	volumeId := id.String()
 
 	capacityBytes := request.GetCapacityRange().GetRequiredBytes()
 	if capacityBytes == 0 {
@@ -50,53 +163,24 @@ func (d *CSIS3Driver) CreateVolume(ctx context.Context, request *csi.CreateVolum
 		klog.Infof("volume capacity has NOT be provided, optional volume capacity is used: %d", capacityBytes)
 	}
 
-	pv, err := d.client.CoreV1().PersistentVolumes().Get(ctx, volumeId, metav1.GetOptions{})
-	if err != nil && strings.Contains(err.Error(), "not found") {
-		switch e := err.(type) {
-		case *errors.StatusError:
-			if e.Status().Code != int32(http.StatusNotFound) {
-				return nil, status.Error(codes.Internal, fmt.Sprintf("failed to fetch PersistVolume %s from API server: %v", volumeId, err.Error()))
-			}
-		default:
-		}
-	}
-	if pv != nil {
-		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == d.Config.DriverName {
-			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("volume is not created by current CSI: %s", volumeId))
-		}
-		capacity := pv.Spec.Capacity.Storage().Value()
-		if capacity != 0 && capacity != capacityBytes {
-			return &csi.CreateVolumeResponse{}, status.Error(codes.AlreadyExists,
-				fmt.Sprintf("failed to create a volume with already existing name and different capacity: expected one is %d, and request is %d",
-					capacityBytes,
-					pv.Spec.Capacity.Storage().Value(),
-				))
-		}
-		klog.Infof("volume already existed: %s", volumeId)
-		return &csi.CreateVolumeResponse{
-			Volume: &csi.Volume{
-				VolumeId:      volumeId,
-				VolumeContext: request.GetParameters(),
-				CapacityBytes: capacityBytes,
-			},
-		}, nil
-	}
-
 	klog.Infof("got a request to create volume %s", volumeId)
 
 	metadata := &s3.Metadata{
 		BucketName:    bucket,
+		FsPathPrefix:  prefix,
 		Mounter:       mounterType,
 		CapacityBytes: capacityBytes,
+		OnDelete:      onDelete,
+		VolumeId:      volumeId,
 	}
 
 	// Construct S3 client.
-	s3client, err := s3.NewClientFromSecrets(request.GetSecrets())
-	s3client.Config.Mounter = mounterType
-
+	s3client, err := s3.NewClientFromSecrets(secrets)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to initialize S3 client: %v", err.Error()))
 	}
+	s3client.Config.Bucket = bucket
+	s3client.Config.Mounter = mounterType
 
 	// Determine whether the bucket exists.
 	// Compare the capacity if exists. Otherwise, create the target bucket.
@@ -105,28 +189,68 @@ func (d *CSIS3Driver) CreateVolume(ctx context.Context, request *csi.CreateVolum
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to check if bucket `%s` exists: %v", bucket, err.Error()))
 	}
 	if exists {
-		_, err = s3client.GetMetadata()
-		if err != nil {
+		// The metadata in the bucket is the only state of the volume, so the
+		// request is idempotent if the metadata of the same volume exists.
+		existing, err := s3client.GetMetadata(prefix)
+		if err != nil && !s3.IsNotFound(err) {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to fetch metadata: %v", err.Error()))
 		}
+		switch {
+		case err == nil && (existing.VolumeId == volumeId || len(prefix) != 0):
+			if err := checkMetadata(id, existing); err != nil {
+				return nil, status.Error(codes.AlreadyExists, err.Error())
+			}
+			if existing.CapacityBytes != capacityBytes {
+				return nil, status.Error(codes.AlreadyExists,
+					fmt.Sprintf("failed to create a volume with already existing name and different capacity: expected one is %d, and request is %d",
+						existing.CapacityBytes,
+						capacityBytes,
+					))
+			}
+			klog.Infof("volume already existed: %s", volumeId)
+			d.addBackend(bucket, secrets)
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					VolumeId:      volumeId,
+					VolumeContext: parameters,
+					CapacityBytes: capacityBytes,
+				},
+			}, nil
+		case err == nil:
+			// The volumes of the whole bucket share the metadata, which must
+			// not be taken over by another volume.
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("bucket `%s` is already provisioned for volume %s", bucket, existing.VolumeId))
+		case dedicated:
+			// The empty bucket is left by an earlier attempt of this request,
+			// which failed before the metadata has been stored.
+			unused, err := s3client.BucketUnused()
+			if err != nil {
+				return nil, status.Error(codes.Internal, fmt.Sprintf("failed to list bucket `%s`: %v", bucket, err.Error()))
+			}
+			if !unused {
+				return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("bucket `%s` already exists, but is not provisioned for volume %s", bucket, volumeId))
+			}
+			klog.Infof("bucket `%s` is empty, resuming the creation of volume %s", bucket, volumeId)
+		}
 	} else {
 		if err = s3client.CreateBucket(); err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to create bucket `%s`: %v", bucket, err.Error()))
 		}
 	}
 
-	if err = s3client.CreatePrefix(); err != nil {
+	if err = s3client.CreatePrefix(prefix); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to create prefix: %v", err.Error()))
 	}
 	if err = s3client.SetMetadata(metadata); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to set bucket metadata: %v", err.Error()))
 	}
 
+	d.addBackend(bucket, secrets)
 	klog.Infof("Create volume %s", volumeId)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeId,
-			VolumeContext: request.GetParameters(),
+			VolumeContext: parameters,
 			CapacityBytes: capacityBytes,
 		},
 	}, nil
@@ -144,43 +268,126 @@ func (d *CSIS3Driver) DeleteVolume(ctx context.Context, request *csi.DeleteVolum
 
 	klog.Infof("got a request to delete volume %s", volumeId)
 
-	pvs, err := d.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{
-		FieldSelector: fields.OneTermEqualSelector("metadata.name", volumeId).String(),
-	})
+	id, err := volume.Parse(volumeId)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get PersistentVolume: %s", err.Error()))
-	}
-	if len(pvs.Items) > 0 {
-		pv := pvs.Items[0]
-		if pv.Spec.ClaimRef != nil {
-			return nil, status.Error(codes.FailedPrecondition, "volume in use")
-		}
-	} else {
-		return nil, status.Error(codes.Internal, "failed to get PersistentVolume")
+		klog.Infof("volume ID %s is malformed, ignoring delete request: %s", volumeId, err)
+		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	client, err := s3.NewClientFromSecrets(request.GetSecrets())
+	secrets, err := d.requestSecrets(ctx, request.GetSecrets(), nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	client, err := newVolumeClient(id, secrets)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to initialize S3 client: %s", err.Error()))
 	}
 
-	if _, err := client.GetMetadata(); err != nil {
+	if len(client.Config.Bucket) == 0 {
+		klog.Infof("bucket of volume %s is unknown, ignoring delete request", volumeId)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	// Only the missing metadata means the volume is deleted already, the other
+	// errors are retried by the provisioner.
+	metadata, err := client.GetMetadata(id.Prefix)
+	if s3.IsNotFound(err) {
 		klog.Infof("FSMeta of volume %s does not exist, ignoring delete request", volumeId)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get metadata of volume %s: %s", volumeId, err.Error()))
+	}
+
+	// The metadata of the whole bucket may belong to another volume of the same
+	// bucket, whose data must be kept. Legacy metadata carries no volume ID.
+	if len(metadata.VolumeId) != 0 && metadata.VolumeId != volumeId {
+		klog.Infof("FSMeta of volume %s belongs to volume %s, ignoring delete request", volumeId, metadata.VolumeId)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	d.addBackend(client.Config.Bucket, secrets)
+
+	// The data is removed at the prefix of the volume ID, never at the one of
+	// the metadata, which must agree with it.
+	if err := checkMetadata(id, metadata); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("refusing to delete volume %s: %s", volumeId, err.Error()))
+	}
+	if err := checkOnDelete(metadata); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("refusing to delete volume %s: %s", volumeId, err.Error()))
+	}
+
+	// The metadata is always removed, so that the volume is no longer tracked.
+	var deleteErr error
+	switch metadata.OnDelete {
+	case "", onDeleteRetain:
+		klog.Infof("volume %s is retained in bucket `%s`", volumeId, client.Config.Bucket)
+		deleteErr = client.RemoveMetadata(id.Prefix)
+	case onDeleteDeletePrefix:
+		klog.Infof("removing prefix `%s` of volume %s", id.Prefix, volumeId)
+		if deleteErr = client.RemovePrefix(id.Prefix); deleteErr == nil {
+			deleteErr = client.RemoveMetadata(id.Prefix)
+		}
+	case onDeleteDeleteBucket:
+		klog.Infof("removing bucket `%s` of volume %s", client.Config.Bucket, volumeId)
+		deleteErr = client.RemoveBucket()
+	case onDeleteArchive:
+		archive := fmt.Sprintf("%s/%s-%s", archivePrefix, strings.ReplaceAll(volumeId, "/", "_"), time.Now().UTC().Format("20060102150405"))
+		klog.Infof("archiving prefix `%s` of volume %s to `%s`", id.Prefix, volumeId, archive)
+		if deleteErr = client.ArchivePrefix(id.Prefix, archive); deleteErr == nil {
+			deleteErr = client.RemoveMetadata(id.Prefix)
+		}
+	default:
+		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown reclaim policy of volume %s: %s", volumeId, metadata.OnDelete))
+	}
 
-	//var deleteErr error
-	//if deleteErr != nil {
-	//	klog.Warning("Remove volume failed, will ensure FSMeta exists to avoid losing control over volume")
-	//	if err := client.SetMetadata(bucket, metadata); err != nil {
-	//		klog.Error(err)
-	//	}
-	//	return nil, deleteErr
-	//}
+	if deleteErr != nil {
+		klog.Warning("Remove volume failed, will ensure FSMeta exists to avoid losing control over volume")
+		if err := client.SetMetadata(metadata); err != nil {
+			klog.Error(err)
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to remove volume %s: %s", volumeId, deleteErr.Error()))
+	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// validateOnDelete validates that the reclaim policy only removes the data of
+// the volume: deleteBucket requires a bucket per volume, while deletePrefix and
+// archive require a prefix per volume, since the other volumes may share the
+// bucket.
+func validateOnDelete(onDelete string, mode string) error {
+	switch onDelete {
+	case onDeleteDeleteBucket:
+		if mode != provisioningModeBucket {
+			return fmt.Errorf("reclaim policy %s requires %s %s", onDelete, constant.ProvisioningModeKey, provisioningModeBucket)
+		}
+	case onDeleteDeletePrefix, onDeleteArchive:
+		if mode != provisioningModePrefix {
+			return fmt.Errorf("reclaim policy %s requires %s %s", onDelete, constant.ProvisioningModeKey, provisioningModePrefix)
+		}
+	}
+	return nil
+}
+
+// checkOnDelete guards DeleteVolume against the metadata whose reclaim policy
+// would remove the data of other volumes, e.g. written by older versions: the
+// bucket of a volume with a prefix is shared, and the prefix of a volume of the
+// whole bucket is empty, covering the whole bucket.
+func checkOnDelete(metadata *s3.Metadata) error {
+	switch metadata.OnDelete {
+	case onDeleteDeleteBucket:
+		if len(metadata.FsPathPrefix) != 0 {
+			return fmt.Errorf("reclaim policy %s would remove bucket `%s` shared by prefix `%s`", metadata.OnDelete, metadata.BucketName, metadata.FsPathPrefix)
+		}
+	case onDeleteDeletePrefix, onDeleteArchive:
+		if len(metadata.FsPathPrefix) == 0 {
+			return fmt.Errorf("reclaim policy %s would cover the whole bucket `%s`", metadata.OnDelete, metadata.BucketName)
+		}
+	}
+	return nil
+}
+
 func (d *CSIS3Driver) ControllerPublishVolume(_ context.Context, _ *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "ControllerPublishVolume is unimplemented.")
 }
@@ -189,14 +396,33 @@ func (d *CSIS3Driver) ControllerUnpublishVolume(_ context.Context, _ *csi.Contro
 	return nil, status.Error(codes.Unimplemented, "ControllerUnpublishVolume is unimplemented.")
 }
 
-func (d *CSIS3Driver) ValidateVolumeCapabilities(_ context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+func (d *CSIS3Driver) ValidateVolumeCapabilities(ctx context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	if len(request.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume name missing in request")
 	}
 	if request.GetVolumeCapabilities() == nil || len(request.GetVolumeCapabilities()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume capabilities missing in request")
 	}
+	secrets, err := d.requestSecrets(ctx, request.GetSecrets(), request.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	metadata, client, err := d.lookupVolume(request.GetVolumeId(), secrets)
+	if err != nil {
+		return nil, err
+	}
 
+	parameters := request.GetVolumeContext()
+	if len(parameters) == 0 {
+		parameters = request.GetParameters()
+	}
+	if err := d.validateVolumeCapabilities(request.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	mounterType := mounter.ResolveType(metadata, client.Config)
+	if err := validateMounterCapabilities(mounterType, parameters, request.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
 			VolumeCapabilities: request.GetVolumeCapabilities(),
@@ -204,55 +430,105 @@ func (d *CSIS3Driver) ValidateVolumeCapabilities(_ context.Context, request *csi
 	}, nil
 }
 
-func (d *CSIS3Driver) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+// lookupVolume returns the metadata of the volume and the client of its bucket,
+// given by the secrets, or by the buckets seen so far if there is none.
+func (d *CSIS3Driver) lookupVolume(volumeId string, secrets map[string]string) (*s3.Metadata, *s3.S3Client, error) {
+	id, err := volume.Parse(volumeId)
+	if err != nil {
+		return nil, nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found: %s", volumeId, err.Error()))
+	}
+	candidates := []map[string]string{secrets}
+	if len(secrets) == 0 {
+		candidates = nil
+		for _, backend := range d.listBackends() {
+			if len(id.Bucket) == 0 || backend[constant.BucketKey] == id.Bucket {
+				candidates = append(candidates, backend)
+			}
+		}
+	}
+	for _, secrets := range candidates {
+		client, err := newVolumeClient(id, secrets)
+		if err != nil {
+			return nil, nil, status.Error(codes.Internal, fmt.Sprintf("failed to initialize S3 client: %s", err.Error()))
+		}
+		if len(client.Config.Bucket) == 0 {
+			continue
+		}
+		metadata, err := client.GetMetadata(id.Prefix)
+		if s3.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, status.Error(codes.Internal, fmt.Sprintf("failed to get metadata of volume %s: %s", volumeId, err.Error()))
+		}
+		if len(metadata.VolumeId) != 0 && metadata.VolumeId != volumeId {
+			continue
+		}
+		if err := checkMetadata(id, metadata); err != nil {
+			return nil, nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return metadata, client, nil
+	}
+	return nil, nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found", volumeId))
+}
+
+func (d *CSIS3Driver) ListVolumes(_ context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := d.validateControllerServiceRequestCapability(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return nil, err
+	}
+
 	startToken := request.StartingToken
 	if startToken == "" {
 		startToken = "0"
 	}
 	start, err := strconv.Atoi(startToken)
-	if err != nil {
+	if err != nil || start < 0 {
 		return &csi.ListVolumesResponse{}, status.Error(codes.Aborted, fmt.Sprintf(
 			"the type of starting token should be a integer: %s", request.StartingToken))
 	}
 
-	pvs, err := d.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return &csi.ListVolumesResponse{}, status.Error(codes.Internal, fmt.Sprintf("%s", err.Error()))
-	}
-
-	entries := stream.Map(
-		stream.Of(pvs.Items...).
-			Filter(func(pv v1.PersistentVolume) bool {
-				if pv.Annotations["pv.kubernetes.io/provisioned-by"] == d.Config.DriverName {
-					return true
-				}
-				return false
-			}).
-			Filter(func(pv v1.PersistentVolume) bool {
-				if pv.Spec.CSI == nil {
-					return false
-				}
-				return pv.Spec.CSI.Driver == d.Config.DriverName
-			}).
-			Filter(func(pv v1.PersistentVolume) bool {
-				return mapset.NewSet(v1.VolumeAvailable, v1.VolumeBound).
-					Contains(pv.Status.Phase)
-			}).Skip(start),
-		func(pv v1.PersistentVolume) *csi.ListVolumesResponse_Entry {
-			return &csi.ListVolumesResponse_Entry{
+	// The volumes are listed from the metadata in the buckets seen so far,
+	// since the request carries no secret.
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, secrets := range d.listBackends() {
+		client, err := s3.NewClientFromSecrets(secrets)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to initialize S3 client: %s", err.Error()))
+		}
+		metadataList, err := client.ListMetadata()
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to list volumes of bucket `%s`: %s", client.Config.Bucket, err.Error()))
+		}
+		for _, metadata := range metadataList {
+			entries = append(entries, &csi.ListVolumesResponse_Entry{
 				Volume: &csi.Volume{
-					CapacityBytes: pv.Spec.Capacity.Storage().Value(),
-					VolumeId:      pv.Name,
-					VolumeContext: pv.Spec.CSI.VolumeAttributes,
+					CapacityBytes: metadata.CapacityBytes,
+					VolumeId:      metadata.VolumeId,
 				},
 				Status: &csi.ListVolumesResponse_VolumeStatus{},
-			}
-		},
-	).ToSlice()
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].GetVolume().GetVolumeId() < entries[j].GetVolume().GetVolumeId()
+	})
+
+	if start > len(entries) {
+		return &csi.ListVolumesResponse{}, status.Error(codes.Aborted, fmt.Sprintf(
+			"the starting token exceeds the number of volumes: %s", request.StartingToken))
+	}
+	end := len(entries)
+	if request.MaxEntries > 0 && start+int(request.MaxEntries) < end {
+		end = start + int(request.MaxEntries)
+	}
+	var nextToken string
+	if end < len(entries) {
+		nextToken = strconv.Itoa(end)
+	}
 
 	return &csi.ListVolumesResponse{
-		Entries:   entries,
-		NextToken: strconv.Itoa(len(entries) + 1),
+		Entries:   entries[start:end],
+		NextToken: nextToken,
 	}, nil
 }
 
@@ -290,7 +566,65 @@ func (d *CSIS3Driver) ControllerGetVolume(_ context.Context, request *csi.Contro
 		return nil, err
 	}
 
-	return nil, status.Error(codes.Unimplemented, "ControllerGetVolume is NOT supported.")
+	volumeId := request.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	id, err := volume.Parse(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found: %s", volumeId, err.Error()))
+	}
+
+	// The request carries no secret, so the volume is looked up in the buckets
+	// seen so far.
+	found := false
+	for _, secrets := range d.listBackends() {
+		if len(id.Bucket) != 0 && secrets[constant.BucketKey] != id.Bucket {
+			continue
+		}
+		found = true
+		client, err := newVolumeClient(id, secrets)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to initialize S3 client: %s", err.Error()))
+		}
+		metadata, err := client.GetMetadata(id.Prefix)
+		if s3.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: volumeId},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: backendCondition(client, err),
+				},
+			}, nil
+		}
+		if len(metadata.VolumeId) != 0 && metadata.VolumeId != volumeId {
+			continue
+		}
+		if err := checkMetadata(id, metadata); err != nil {
+			return &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: volumeId},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: abnormalCondition("%s", err.Error()),
+				},
+			}, nil
+		}
+		return &csi.ControllerGetVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:      volumeId,
+				CapacityBytes: metadata.CapacityBytes,
+			},
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+				VolumeCondition: normalCondition(),
+			},
+		}, nil
+	}
+
+	if !found {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("secrets of the bucket of volume %s are unknown yet", volumeId))
+	}
+	return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found", volumeId))
 }
 
 func (d *CSIS3Driver) ControllerModifyVolume(_ context.Context, _ *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
@@ -311,14 +645,21 @@ func (d *CSIS3Driver) validateControllerServiceRequestCapability(c csi.Controlle
 }
 
 func (d *CSIS3Driver) getControllerServiceCapabilities() []*csi.ControllerServiceCapability {
-	return stream.Map(stream.Of(
+	capabilities := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-		csi.ControllerServiceCapability_RPC_GET_VOLUME,
-		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
-	), func(cap csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	}
+	// The volumes are only known in the buckets seen since the controller
+	// started, so listing them is best-effort and opted in.
+	if d.Config.ListVolumes {
+		capabilities = append(capabilities,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		)
+	}
+	return stream.Map(stream.OfSlice(capabilities), func(cap csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
 		return &csi.ControllerServiceCapability{
 			Type: &csi.ControllerServiceCapability_Rpc{
 				Rpc: &csi.ControllerServiceCapability_RPC{
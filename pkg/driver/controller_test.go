@@ -0,0 +1,296 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateOnDelete(t *testing.T) {
+	cases := []struct {
+		onDelete string
+		mode     string
+		expected bool
+	}{
+		{onDeleteRetain, provisioningModeShared, true},
+		{onDeleteDeleteBucket, provisioningModeBucket, true},
+		{onDeleteDeleteBucket, provisioningModePrefix, false},
+		{onDeleteDeleteBucket, provisioningModeShared, false},
+		{onDeleteDeleteBucket, "", false},
+		{onDeleteDeletePrefix, provisioningModePrefix, true},
+		{onDeleteDeletePrefix, provisioningModeShared, false},
+		{onDeleteDeletePrefix, provisioningModeBucket, false},
+		{onDeleteArchive, provisioningModePrefix, true},
+		{onDeleteArchive, "", false},
+	}
+	for _, c := range cases {
+		if err := validateOnDelete(c.onDelete, c.mode); (err == nil) != c.expected {
+			t.Errorf("validateOnDelete(%s, %s) error = %v, expected success %v", c.onDelete, c.mode, err, c.expected)
+		}
+	}
+}
+
+func TestCheckOnDelete(t *testing.T) {
+	cases := []struct {
+		onDelete string
+		prefix   string
+		expected bool
+	}{
+		{onDeleteRetain, "", true},
+		{onDeleteDeleteBucket, "", true},
+		{onDeleteDeleteBucket, "csi-fs/pvc", false},
+		{onDeleteDeletePrefix, "csi-fs/pvc", true},
+		{onDeleteDeletePrefix, "", false},
+		{onDeleteArchive, "", false},
+	}
+	for _, c := range cases {
+		metadata := &s3.Metadata{BucketName: "bucket", FsPathPrefix: c.prefix, OnDelete: c.onDelete}
+		if err := checkOnDelete(metadata); (err == nil) != c.expected {
+			t.Errorf("checkOnDelete(%s at %q) error = %v, expected success %v", c.onDelete, c.prefix, err, c.expected)
+		}
+	}
+}
+
+// newTestController creates a controller with the capabilities added by Run.
+func newTestController(t *testing.T) *CSIS3Driver {
+	d, err := NewDriver("node", "unix:///tmp/csi-s3-test.sock", ModeController)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	d.Driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	return d
+}
+
+// fakeBackend serves MinIO STS for LDAP accounts and an empty S3 bucket, and
+// records whether the S3 requests are signed with the temporary keys.
+type fakeBackend struct {
+	sync.Mutex
+	signed, unsigned int
+}
+
+func (backend *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path == "/" {
+		_ = r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithLDAPIdentity" || r.Form.Get("LDAPPassword") != "password" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`<AssumeRoleWithLDAPIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleWithLDAPIdentityResult><Credentials><AccessKeyId>ldap-key</AccessKeyId><SecretAccessKey>ldap-secret</SecretAccessKey>
+<SessionToken>ldap-token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleWithLDAPIdentityResult>
+</AssumeRoleWithLDAPIdentityResponse>`))
+		return
+	}
+
+	backend.Lock()
+	if strings.Contains(r.Header.Get("Authorization"), "Credential=ldap-key/") && r.Header.Get("X-Amz-Security-Token") == "ldap-token" {
+		backend.signed++
+	} else {
+		backend.unsigned++
+	}
+	backend.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`))
+	case http.MethodPut:
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	}
+}
+
+func TestCreateVolumeLDAP(t *testing.T) {
+	backend := &fakeBackend{}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	d := newTestController(t)
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	response, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-ldap",
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		Parameters:         map[string]string{constant.BucketKey: "bucket"},
+		Secrets: map[string]string{
+			"endpoint":                     server.URL,
+			"region":                       "us-east-1",
+			constant.CredentialProviderKey: s3.CredentialProviderLDAP,
+			constant.LDAPUsernameKey:       "user",
+			constant.LDAPPasswordKey:       "password",
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume with the ldap provider failed: %v", err)
+	}
+	if response.GetVolume().GetVolumeId() == "" {
+		t.Errorf("CreateVolume returned no volume ID")
+	}
+	if backend.signed == 0 || backend.unsigned != 0 {
+		t.Errorf("%d requests signed with the LDAP credentials and %d others, expected only signed ones", backend.signed, backend.unsigned)
+	}
+}
+
+func TestDeleteVolumeMetadataErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		code   codes.Code
+	}{
+		{"missing metadata", http.StatusNotFound, `<Error><Code>NoSuchKey</Code></Error>`, codes.OK},
+		{"missing bucket", http.StatusNotFound, `<Error><Code>NoSuchBucket</Code></Error>`, codes.OK},
+		{"access denied", http.StatusForbidden, `<Error><Code>AccessDenied</Code></Error>`, codes.Internal},
+		{"unavailable backend", http.StatusServiceUnavailable, `<Error><Code>ServiceUnavailable</Code></Error>`, codes.Internal},
+	}
+	d := newTestController(t)
+	for _, c := range cases {
+		removed := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodDelete {
+				removed = true
+			}
+			w.WriteHeader(c.status)
+			_, _ = w.Write([]byte(c.body))
+		}))
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+			VolumeId: "v1:rclone:bucket:csi-fs/pvc:",
+			Secrets:  map[string]string{"endpoint": server.URL, "region": "us-east-1", "accessKeyID": "key", "secretAccessKey": "secret"},
+		})
+		server.Close()
+		if code := status.Code(err); code != c.code {
+			t.Errorf("%s: expected %s, got %v", c.name, c.code, err)
+		}
+		if removed {
+			t.Errorf("%s: DeleteVolume removed data without metadata", c.name)
+		}
+	}
+}
+
+func TestDeleteVolumeWithForeignPrefix(t *testing.T) {
+	modified := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// The metadata is rewritten to point at the prefix of another volume.
+			w.Header().Set("Last-Modified", "Mon, 2 Jan 2006 15:04:05 GMT")
+			_, _ = w.Write([]byte(`{"driverName":"bucket","fsPathPrefix":"csi-fs/pvc-victim","volumeId":"v1:rclone:bucket:csi-fs/pvc:","onDelete":"deletePrefix"}`))
+		case http.MethodHead:
+		default:
+			modified = true
+		}
+	}))
+	defer server.Close()
+
+	d := newTestController(t)
+	_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+		VolumeId: "v1:rclone:bucket:csi-fs/pvc:",
+		Secrets:  map[string]string{"endpoint": server.URL, "region": "us-east-1", "accessKeyID": "key", "secretAccessKey": "secret"},
+	})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected %s, got %v", codes.FailedPrecondition, err)
+	}
+	if modified {
+		t.Error("DeleteVolume modified the bucket after the metadata of another prefix")
+	}
+}
+
+func TestSharedVolumeOfAnotherVolume(t *testing.T) {
+	modified := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Last-Modified", "Mon, 2 Jan 2006 15:04:05 GMT")
+			_, _ = w.Write([]byte(`{"driverName":"bucket","volumeId":"v1::bucket::pvc-other","onDelete":"deleteBucket"}`))
+		case http.MethodHead:
+		default:
+			modified = true
+		}
+	}))
+	defer server.Close()
+	secrets := map[string]string{"endpoint": server.URL, "region": "us-east-1", "accessKeyID": "key", "secretAccessKey": "secret"}
+
+	d := newTestController(t)
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-new",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: map[string]string{constant.BucketKey: "bucket"},
+		Secrets:    secrets,
+	})
+	if code := status.Code(err); code != codes.AlreadyExists {
+		t.Errorf("CreateVolume: expected %s, got %v", codes.AlreadyExists, err)
+	}
+	if _, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "v1::bucket::pvc-new", Secrets: secrets}); err != nil {
+		t.Errorf("DeleteVolume: %v", err)
+	}
+	if modified {
+		t.Errorf("the bucket of volume v1::bucket::pvc-other has been modified")
+	}
+}
+
+func TestCreateVolumeExistingDedicatedBucket(t *testing.T) {
+	cases := []struct {
+		name    string
+		objects []string
+		code    codes.Code
+	}{
+		{"empty bucket", nil, codes.OK},
+		{"bucket left by a failed attempt", []string{"csi-fs/"}, codes.OK},
+		{"bucket with data", []string{"csi-fs/", "data"}, codes.AlreadyExists},
+	}
+	d := newTestController(t)
+	for _, c := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodGet && r.URL.Query().Has("list-type"):
+				contents := ""
+				for _, object := range c.objects {
+					contents += "<Contents><Key>" + object + "</Key><Size>0</Size></Contents>"
+				}
+				_, _ = w.Write([]byte("<ListBucketResult><Name>pvc-dedicated</Name><IsTruncated>false</IsTruncated>" + contents + "</ListBucketResult>"))
+			case r.Method == http.MethodGet:
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			case r.Method == http.MethodPut:
+				w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+			}
+		}))
+		_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: "pvc-dedicated",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			Parameters: map[string]string{constant.ProvisioningModeKey: provisioningModeBucket},
+			Secrets:    map[string]string{"endpoint": server.URL, "region": "us-east-1", "accessKeyID": "key", "secretAccessKey": "secret"},
+		})
+		server.Close()
+		if code := status.Code(err); code != c.code {
+			t.Errorf("%s: expected %s, got %v", c.name, c.code, err)
+		}
+	}
+}
+
+func TestListVolumesOptedIn(t *testing.T) {
+	d := newTestController(t)
+	if _, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListVolumes without --list-volumes: expected %s, got %v", codes.InvalidArgument, err)
+	}
+	d.Config.ListVolumes = true
+	if _, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{}); err != nil {
+		t.Errorf("ListVolumes with --list-volumes: %v", err)
+	}
+}
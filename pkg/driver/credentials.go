@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/leryn1122/csi-s3/pkg/mounter"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+	"github.com/leryn1122/csi-s3/pkg/volume"
+	"k8s.io/klog/v2"
+)
+
+// rotatedSecrets are the keys of the volume, which the secrets of the repeated
+// NodePublishVolume replace while the volume stays mounted. The other settings
+// apply once the volume is staged again.
+var rotatedSecrets = []string{"accessKeyID", "secretAccessKey", constant.SessionTokenKey}
+
+func (v *stagedVolume) s3Client() *s3.S3Client {
+	v.credentialsLock.Lock()
+	defer v.credentialsLock.Unlock()
+	return v.client
+}
+
+// refreshCredentials reads the keys of the staged volume again, e.g. the files
+// of the file provider, and refreshes the credential files of the mounter. The
+// client is kept until the keys are rotated, so that the temporary keys the
+// driver fetches for the mounter are only fetched again once they expire.
+func (d *CSIS3Driver) refreshCredentials(staged *stagedVolume) error {
+	staged.credentialsLock.Lock()
+	defer staged.credentialsLock.Unlock()
+
+	d.Lock()
+	secrets := staged.entry.Secrets
+	d.Unlock()
+	id, err := volume.Parse(staged.entry.VolumeId)
+	if err != nil {
+		return err
+	}
+	client, err := newVolumeClient(id, volumeSecrets(secrets, staged.entry.VolumeContext))
+	if err != nil {
+		return err
+	}
+
+	current := staged.client.Config
+	if current.AccessKeyID != client.Config.AccessKeyID || current.SecretAccessKey != client.Config.SecretAccessKey ||
+		current.SessionToken != client.Config.SessionToken || current.Credentials != client.Config.Credentials {
+		klog.Infof("Credentials of volume %s have been rotated", staged.entry.VolumeId)
+		staged.client = client
+	}
+	config, err := mounter.MounterConfig(staged.entry.Mounter, staged.client)
+	if err != nil {
+		return err
+	}
+	return staged.mounter.UpdateCredentials(config)
+}
+
+// rotateSecrets replaces the keys of the staged volume with the ones of the
+// secrets, if they are given and differ.
+func (d *CSIS3Driver) rotateSecrets(volumeId string, secrets map[string]string) error {
+	d.Lock()
+	staged := d.stagedVolumes[volumeId]
+	var rotated map[string]string
+	if staged != nil {
+		for _, key := range rotatedSecrets {
+			if value, ok := secrets[key]; ok && value != staged.entry.Secrets[key] {
+				if rotated == nil {
+					rotated = maps.Clone(staged.entry.Secrets)
+				}
+				rotated[key] = value
+			}
+		}
+	}
+	d.Unlock()
+	if rotated == nil {
+		return nil
+	}
+
+	// The keys are checked against the bucket before they replace the ones of
+	// the journal, so that mistaken keys never break the mount.
+	id, err := volume.Parse(volumeId)
+	if err != nil {
+		return err
+	}
+	client, err := newVolumeClient(id, volumeSecrets(rotated, staged.entry.VolumeContext))
+	if err != nil {
+		return fmt.Errorf("invalid rotated credentials: %w", err)
+	}
+	if err = mounter.ValidateSessionToken(staged.entry.Mounter, client.Config); err != nil {
+		return fmt.Errorf("invalid rotated credentials: %w", err)
+	}
+	if _, err = client.BucketExists(); err != nil {
+		return fmt.Errorf("rotated credentials are rejected by %s: %w", client.Config.Endpoint, err)
+	}
+	// The secrets are replaced rather than updated, as they are read without
+	// the lock once taken.
+	d.updateJournal(volumeId, func(entry *journalEntry) {
+		entry.Secrets = rotated
+	})
+	if err = d.refreshCredentials(staged); err != nil {
+		return fmt.Errorf("failed to rotate credentials: %w", err)
+	}
+	return nil
+}
+
+// runCredentialRefresher refreshes the credentials of the staged volumes
+// periodically until stop is closed.
+func (d *CSIS3Driver) runCredentialRefresher(stop <-chan struct{}) {
+	ticker := time.NewTicker(mounter.CredentialsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		d.refreshAllCredentials()
+	}
+}
+
+func (d *CSIS3Driver) refreshAllCredentials() {
+	d.Lock()
+	volumes := make([]*stagedVolume, 0, len(d.stagedVolumes))
+	for _, staged := range d.stagedVolumes {
+		volumes = append(volumes, staged)
+	}
+	d.Unlock()
+
+	for _, staged := range volumes {
+		if err := d.refreshCredentials(staged); err != nil {
+			klog.Errorf("Failed to refresh credentials of volume %s: %s", staged.entry.VolumeId, err)
+		}
+	}
+}
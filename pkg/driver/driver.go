@@ -1,12 +1,16 @@
 package driver
 
 import (
+	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"github.com/leryn1122/csi-s3/pkg/kube"
+	"github.com/leryn1122/csi-s3/pkg/mounter"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"sync"
 )
@@ -16,27 +20,53 @@ type CSIS3Driver struct {
 	Config Config
 	Driver *csicommon.CSIDriver
 	client kubernetes.Interface
+	// stagedVolumes holds the volumes staged on the node.
+	stagedVolumes map[string]*stagedVolume
+	// backends holds the secrets of the buckets seen by the controller.
+	backends map[string]map[string]string
+	// supervisor remounts the FUSE mounts of the node once they break.
+	supervisor *mounter.Supervisor
+	recorder   record.EventRecorder
 }
 
-func NewDriver(nodeID string, endpoint string) (*CSIS3Driver, error) {
+func NewDriver(nodeID string, endpoint string, mode string) (*CSIS3Driver, error) {
 	config := NewConfig()
 	config.NodeID = nodeID
 	config.Endpoint = endpoint
+	config.Mode = mode
+	if !config.IsController() && !config.IsNode() {
+		return nil, fmt.Errorf("unknown mode %s, expected one of %s, %s and %s", mode, ModeController, ModeNode, ModeAll)
+	}
 
 	csiDriver := csicommon.NewCSIDriver(config.DriverName, config.Version, nodeID)
 	if csiDriver == nil {
 		klog.Fatalln("Failed to initialize CSI S3 Driver")
 	}
 
+	driver := &CSIS3Driver{
+		Driver:        csiDriver,
+		Config:        config,
+		stagedVolumes: make(map[string]*stagedVolume),
+		backends:      make(map[string]map[string]string),
+	}
+
+	// The Kubernetes API is optional, e.g. the driver runs under Nomad or with
+	// csi-sanity against a local S3 stand-in. It is used to record events and
+	// to read the CA bundles given by ConfigMaps.
 	kubeClient, err := kube.CreateKubeClient()
 	if err != nil {
-		return nil, err
+		klog.Warningf("Kubernetes API is unavailable: %s", err.Error())
+	} else {
+		driver.client = kubeClient
+		driver.recorder = newEventRecorder(kubeClient, config.DriverName, nodeID)
 	}
 
-	driver := &CSIS3Driver{
-		Driver: csiDriver,
-		Config: config,
-		client: kubeClient,
+	if config.IsNode() {
+		for _, missing := range mounter.MissingBinaries() {
+			klog.Warningf("FUSE binary %s is not found, volumes with mounter %s will fail to stage", missing, missing)
+		}
+		driver.supervisor = mounter.NewSupervisor(driver.recordEvent, driver.remounted)
+		driver.recoverVolumes()
 	}
 	return driver, nil
 }
@@ -46,11 +76,33 @@ func (d *CSIS3Driver) Run() error {
 	klog.Infof("Version: %v", d.Config.Version)
 
 	d.Driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
-	d.Driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	d.Driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	})
+
+	klog.Infof("Mode: %v", d.Config.Mode)
+
+	// Only the services of the mode are registered.
+	var controllerServer csi.ControllerServer
+	var nodeServer csi.NodeServer
+	if d.Config.IsController() {
+		controllerServer = d
+	}
+	if d.Config.IsNode() {
+		nodeServer = d
+		go d.supervisor.Run(wait.NeverStop)
+		go d.runGarbageCollector(wait.NeverStop)
+		go d.runCredentialRefresher(wait.NeverStop)
+	}
 
 	grpcServer := csicommon.NewNonBlockingGRPCServer()
 	grpc.WithTransportCredentials(insecure.NewCredentials())
-	grpcServer.Start(d.Config.Endpoint, d, d, d)
+	grpcServer.Start(d.Config.Endpoint, d, controllerServer, nodeServer)
 	grpcServer.Wait()
 
 	return nil
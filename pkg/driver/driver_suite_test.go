@@ -28,25 +28,29 @@ var _ = Describe("csi-s3driver", func() {
 			o.Expect(err).NotTo(o.HaveOccurred())
 		}
 
-		driver, err := NewDriver("unittest-node", csiEndpoint)
+		driver, err := NewDriver("unittest-node", csiEndpoint, ModeAll)
 		if err != nil {
 			log.Fatal(err)
 		}
+		driver.Config.ListVolumes = true
 		go driver.Run()
 
 		Describe("CSI sanity", func() {
-			sanityConfig := &sanity.TestConfig{
-				Address: csiEndpoint,
-				DialOptions: []grpc.DialOption{
-					grpc.WithTransportCredentials(insecure.NewCredentials()),
-				},
-				ControllerDialOptions: []grpc.DialOption{
-					grpc.WithTransportCredentials(insecure.NewCredentials()),
-				},
-				SecretsFile:    "../../test/secret.yaml",
-				TestVolumeSize: int64(512 * bytesize.MB), // 512 MB
+			sanityConfig := sanity.NewTestConfig()
+			sanityConfig.Address = csiEndpoint
+			sanityConfig.DialOptions = []grpc.DialOption{
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
 			}
-			sanity.GinkgoTest(sanityConfig)
+			sanityConfig.ControllerDialOptions = []grpc.DialOption{
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			}
+			sanityConfig.SecretsFile = "../../test/secret.yaml"
+			sanityConfig.TestVolumeSize = int64(512 * bytesize.MB) // 512 MB
+			sanityConfig.TestVolumeParameters = map[string]string{
+				"bucket":           "csi-sanity",
+				"provisioningMode": "prefix",
+			}
+			sanity.GinkgoTest(&sanityConfig)
 		})
 	})
 })
@@ -0,0 +1,36 @@
+package driver
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+func newEventRecorder(client kubernetes.Interface, driverName string, nodeID string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: driverName, Host: nodeID})
+}
+
+// recordEvent logs the event of the volume, and records it on the Node object
+// if the Kubernetes API is available.
+func (d *CSIS3Driver) recordEvent(volumeId string, eventType string, reason string, message string) {
+	if eventType == corev1.EventTypeWarning {
+		klog.Warningf("%s: volume %s: %s", reason, volumeId, message)
+	} else {
+		klog.Infof("%s: volume %s: %s", reason, volumeId, message)
+	}
+	if d.recorder == nil {
+		return
+	}
+	node := &corev1.ObjectReference{
+		Kind: "Node",
+		Name: d.Config.NodeID,
+		UID:  types.UID(d.Config.NodeID),
+	}
+	d.recorder.Eventf(node, eventType, reason, "Volume %s: %s", volumeId, message)
+}
@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leryn1122/csi-s3/pkg/mounter"
+	"k8s.io/klog/v2"
+)
+
+// gcInterval is the interval between the garbage collections on the node.
+const gcInterval = 10 * time.Minute
+
+// stagingDir is where kubelet creates the staging paths of the driver.
+func (d *CSIS3Driver) stagingDir() string {
+	return filepath.Join("/var/lib/kubelet/plugins/kubernetes.io/csi", d.Config.DriverName) + "/"
+}
+
+// runGarbageCollector collects the garbage periodically until stop is closed.
+func (d *CSIS3Driver) runGarbageCollector(stop <-chan struct{}) {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		d.collectGarbage()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectGarbage cleans up what the volumes no longer staged left behind, e.g.
+// when the driver crashed in the middle of NodeUnstageVolume: the FUSE mounts
+// in the staging dir of the driver unknown to the journal, and the credential
+// files of the volumes unknown to the journal.
+func (d *CSIS3Driver) collectGarbage() {
+	// The journal entry is written under the lock before a volume is staged,
+	// so nothing found while holding the lock is mounted by a pending stage.
+	d.Lock()
+	entries, err := loadJournalEntries()
+	if err != nil {
+		d.Unlock()
+		klog.Errorf("Failed to load journal: %s", err)
+		return
+	}
+	volumeIds := make(map[string]bool)
+	stagePaths := make(map[string]bool)
+	for _, entry := range entries {
+		volumeIds[entry.VolumeId] = true
+		stagePaths[entry.StagingPath] = true
+	}
+	for volumeId, staged := range d.stagedVolumes {
+		volumeIds[volumeId] = true
+		stagePaths[staged.entry.StagingPath] = true
+	}
+
+	mounted, err := fuseMountPoints()
+	if err != nil {
+		klog.Errorf("Failed to list mount points: %s", err)
+	}
+	orphans := orphanedMounts(mounted, d.stagingDir(), stagePaths)
+	if err = mounter.CleanupCredentials(volumeIds, stagePaths); err != nil {
+		klog.Errorf("Failed to clean up credentials: %s", err)
+	}
+	d.Unlock()
+
+	for _, path := range orphans {
+		klog.Infof("Unmount orphaned FUSE mount %s", path)
+		if err := mounter.FuseUmount(context.Background(), path); err != nil {
+			klog.Errorf("Failed to unmount orphaned FUSE mount %s: %s", path, err)
+		}
+	}
+}
+
+// orphanedMounts returns the mount points in the staging dir which are not the
+// staging path of any known volume.
+func orphanedMounts(mounted map[string]bool, stagingDir string, stagePaths map[string]bool) []string {
+	var orphans []string
+	for path := range mounted {
+		if strings.HasPrefix(path, stagingDir) && !stagePaths[path] {
+			orphans = append(orphans, path)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
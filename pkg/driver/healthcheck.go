@@ -1,8 +1,60 @@
 package driver
 
-type MountPointInfo struct {
-	Source  string
-	Target  string
-	FsType  string
-	Options string
+import (
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/leryn1122/csi-s3/pkg/mounter"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+	"k8s.io/klog/v2"
+)
+
+func normalCondition() *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is healthy",
+	}
+}
+
+func abnormalCondition(format string, args ...any) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// backendCondition describes the error raised by the S3 backend of the volume,
+// e.g. an unreachable endpoint or revoked credentials.
+func backendCondition(client *s3.S3Client, err error) *csi.VolumeCondition {
+	if s3.IsAccessDenied(err) {
+		return abnormalCondition("credentials of bucket %s are rejected by %s: %s", client.Config.Bucket, client.Config.Endpoint, err.Error())
+	}
+	if s3.IsNotFound(err) {
+		return abnormalCondition("bucket %s does not exist on %s", client.Config.Bucket, client.Config.Endpoint)
+	}
+	return abnormalCondition("endpoint %s is unreachable: %s", client.Config.Endpoint, err.Error())
+}
+
+// checkBackend checks whether the bucket of the volume is reachable with the
+// credentials of the volume.
+func checkBackend(client *s3.S3Client) *csi.VolumeCondition {
+	exists, err := client.BucketExists()
+	if err != nil {
+		return backendCondition(client, err)
+	}
+	if !exists {
+		return abnormalCondition("bucket %s does not exist on %s", client.Config.Bucket, client.Config.Endpoint)
+	}
+	return normalCondition()
+}
+
+// checkStagedVolume checks the FUSE process of the staged volume and its
+// backend. The stale mount point is detected earlier by statfs.
+func checkStagedVolume(v *stagedVolume) *csi.VolumeCondition {
+	alive, err := mounter.IsFuseProcessAlive(v.entry.StagingPath)
+	if err != nil {
+		klog.Warningf("Unable to check FUSE process of %s: %s", v.entry.StagingPath, err)
+	} else if !alive {
+		return abnormalCondition("FUSE process mounting %s is not running", v.entry.StagingPath)
+	}
+	return checkBackend(v.s3Client())
 }
@@ -0,0 +1,363 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/leryn1122/csi-s3/pkg/mounter"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+	"github.com/leryn1122/csi-s3/pkg/volume"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+)
+
+// journalDir holds the journal of the mounts on the node, one entry per staged
+// volume, so that the driver re-adopts the mounts after it restarts and cleans
+// up the ones left behind.
+var journalDir = filepath.Join(constant.PluginDir, "volumes")
+
+// journalEntry records the mounts of a volume. It is written before the volume
+// is staged, so that no mount of the driver is ever unknown to the journal.
+type journalEntry struct {
+	VolumeId    string `json:"volumeId"`
+	StagingPath string `json:"stagingPath"`
+	// Targets holds the published target paths, and whether they are read-only.
+	Targets map[string]bool `json:"targets,omitempty"`
+	Mounter string          `json:"mounter,omitempty"`
+	// Options are the arguments of the FUSE process.
+	Options []string `json:"options,omitempty"`
+	PID     int      `json:"pid,omitempty"`
+	// ReadOnly tells whether the FUSE mount is read-only, as required by the
+	// access mode of the volume.
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// MountFlags are the mount options of the StorageClass.
+	MountFlags []string `json:"mountFlags,omitempty"`
+	// Metadata is the metadata of the volume, so that the volume is re-adopted
+	// without reaching the bucket.
+	Metadata *s3.Metadata `json:"metadata,omitempty"`
+
+	VolumeContext map[string]string `json:"volumeContext,omitempty"`
+	// Secrets are required to stage the volume again, so the journal is only
+	// readable by root like the credential files.
+	Secrets map[string]string `json:"secrets,omitempty"`
+}
+
+// stagedVolume is the node state of a volume staged on the node.
+type stagedVolume struct {
+	mounter  mounter.Mounter
+	metadata *s3.Metadata
+	entry    *journalEntry
+
+	// credentialsLock serializes the refreshes of the credentials, and guards
+	// client, which is replaced once the keys of the volume are rotated.
+	credentialsLock sync.Mutex
+	client          *s3.S3Client
+
+	// usageLock guards usage, and metadata as long as metadataPending.
+	usageLock sync.Mutex
+	usage     *prefixUsage
+	// metadataPending tells that the metadata is derived from the volume ID,
+	// as the bucket was unreachable once the volume was re-adopted.
+	metadataPending bool
+}
+
+// newStagedVolume creates the S3 client and the mounter of the volume.
+func newStagedVolume(id *volume.ID, entry *journalEntry) (*stagedVolume, error) {
+	client, err := newVolumeClient(id, volumeSecrets(entry.Secrets, entry.VolumeContext))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize S3 client: %w", err)
+	}
+	metadata, err := client.GetMetadata(id.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	if err = checkMetadata(id, metadata); err != nil {
+		return nil, err
+	}
+	entry.Metadata = metadata
+	return newMountedVolume(client, id, entry, metadata)
+}
+
+// adoptedVolume creates the S3 client and the mounter of the volume from its
+// journal entry, so that a brief outage of the bucket never leaves a mounted
+// volume unknown. The entries of older versions lack the metadata, which is
+// then derived from the volume ID until the bucket is reachable again.
+func adoptedVolume(id *volume.ID, entry *journalEntry) (*stagedVolume, error) {
+	client, err := newVolumeClient(id, volumeSecrets(entry.Secrets, entry.VolumeContext))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize S3 client: %w", err)
+	}
+	if entry.Metadata != nil {
+		if err = checkMetadata(id, entry.Metadata); err != nil {
+			return nil, err
+		}
+		return newMountedVolume(client, id, entry, entry.Metadata)
+	}
+	metadata, err := client.GetMetadata(id.Prefix)
+	if err == nil {
+		if err = checkMetadata(id, metadata); err != nil {
+			return nil, err
+		}
+		entry.Metadata = metadata
+		return newMountedVolume(client, id, entry, metadata)
+	}
+	klog.Warningf("Failed to get metadata of volume %s, deriving it from the volume ID: %s", entry.VolumeId, err)
+	staged, err := newMountedVolume(client, id, entry, &s3.Metadata{
+		BucketName:   client.Config.Bucket,
+		FsPathPrefix: id.Prefix,
+		Mounter:      entry.Mounter,
+		VolumeId:     entry.VolumeId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	staged.metadataPending = true
+	return staged, nil
+}
+
+// newMountedVolume creates the mounter of the volume. The mount source is taken
+// from the volume ID rather than the metadata, like the metadata itself.
+func newMountedVolume(client *s3.S3Client, id *volume.ID, entry *journalEntry, metadata *s3.Metadata) (*stagedVolume, error) {
+	source := *metadata
+	source.BucketName, source.FsPathPrefix = client.Config.Bucket, id.Prefix
+	mounterType := mounter.ResolveType(metadata, client.Config)
+	config, err := mounter.MounterConfig(mounterType, client)
+	if err != nil {
+		return nil, err
+	}
+	mnt, err := mounter.NewMounter(entry.VolumeId, &source, config, entry.volumeOptions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mounter %s: %w", metadata.Mounter, err)
+	}
+	entry.Mounter = mounterType
+	return &stagedVolume{
+		mounter:  mnt,
+		client:   client,
+		metadata: metadata,
+		entry:    entry,
+	}, nil
+}
+
+// fetchMetadata fetches the metadata of the volume re-adopted without it.
+func (v *stagedVolume) fetchMetadata() error {
+	if !v.metadataPending {
+		return nil
+	}
+	id, err := volume.Parse(v.entry.VolumeId)
+	if err != nil {
+		return err
+	}
+	metadata, err := v.s3Client().GetMetadata(id.Prefix)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata: %w", err)
+	}
+	if err = checkMetadata(id, metadata); err != nil {
+		return err
+	}
+	v.metadata = metadata
+	v.metadataPending = false
+	return nil
+}
+
+func (entry *journalEntry) volumeOptions() mounter.VolumeOptions {
+	return mounter.VolumeOptions{
+		Parameters: entry.VolumeContext,
+		MountFlags: entry.MountFlags,
+		ReadOnly:   entry.ReadOnly,
+	}
+}
+
+// recordFuseMount records the FUSE process mounting the staging path.
+func (entry *journalEntry) recordFuseMount() {
+	if fuse := mounter.LookupFuseMount(entry.StagingPath); fuse != nil {
+		entry.Options = fuse.Args
+		entry.PID = fuse.PID
+	}
+}
+
+func journalFile(volumeId string) string {
+	return filepath.Join(journalDir, url.PathEscape(volumeId)+".json")
+}
+
+// saveJournalEntry writes the journal entry of the volume atomically.
+func saveJournalEntry(entry *journalEntry) error {
+	if err := os.MkdirAll(journalDir, 0700); err != nil {
+		return err
+	}
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(journalDir, ".entry-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), journalFile(entry.VolumeId))
+}
+
+func removeJournalEntry(volumeId string) error {
+	if err := os.Remove(journalFile(volumeId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadJournalEntry returns the journal entry of the volume, or nil if there is
+// none.
+func loadJournalEntry(volumeId string) (*journalEntry, error) {
+	content, err := os.ReadFile(journalFile(volumeId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entry journalEntry
+	if err = json.Unmarshal(content, &entry); err != nil {
+		return nil, err
+	}
+	if entry.Targets == nil {
+		entry.Targets = make(map[string]bool)
+	}
+	return &entry, nil
+}
+
+func loadJournalEntries() ([]*journalEntry, error) {
+	files, err := os.ReadDir(journalDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []*journalEntry
+	for _, file := range files {
+		name, found := strings.CutSuffix(file.Name(), ".json")
+		if file.IsDir() || !found {
+			continue
+		}
+		volumeId, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		entry, err := loadJournalEntry(volumeId)
+		if err != nil {
+			klog.Warningf("Ignore malformed journal entry %s: %s", file.Name(), err)
+			continue
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// updateJournal updates the journal entry of the volume and saves it.
+func (d *CSIS3Driver) updateJournal(volumeId string, update func(entry *journalEntry)) {
+	d.Lock()
+	defer d.Unlock()
+	var entry *journalEntry
+	if staged := d.stagedVolumes[volumeId]; staged != nil {
+		entry = staged.entry
+	} else {
+		var err error
+		if entry, err = loadJournalEntry(volumeId); err != nil || entry == nil {
+			return
+		}
+	}
+	update(entry)
+	if err := saveJournalEntry(entry); err != nil {
+		klog.Warningf("Failed to save journal entry of volume %s: %s", volumeId, err)
+	}
+}
+
+// fuseMountPoints returns the FUSE mount points on the node.
+func fuseMountPoints() (map[string]bool, error) {
+	mountPoints, err := mount.New("").List()
+	if err != nil {
+		return nil, err
+	}
+	mounted := make(map[string]bool)
+	for _, mountPoint := range mountPoints {
+		if strings.HasPrefix(mountPoint.Type, "fuse") {
+			mounted[mountPoint.Path] = true
+		}
+	}
+	return mounted, nil
+}
+
+// recoverVolumes re-adopts the FUSE mounts left by the previous driver, e.g.
+// the ones launched by systemd-run. The mounts whose FUSE process died with the
+// previous driver are remounted by the supervisor. The volumes not mounted any
+// more are forgotten, as kubelet stages them again.
+func (d *CSIS3Driver) recoverVolumes() {
+	entries, err := loadJournalEntries()
+	if err != nil {
+		klog.Errorf("Failed to load journal: %s", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	mounted, err := fuseMountPoints()
+	if err != nil {
+		klog.Errorf("Failed to list mount points: %s", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !mounted[entry.StagingPath] {
+			klog.Infof("Volume %s is no longer mounted at %s, forgetting it", entry.VolumeId, entry.StagingPath)
+			if err := removeJournalEntry(entry.VolumeId); err != nil {
+				klog.Warningf("Failed to remove journal entry of volume %s: %s", entry.VolumeId, err)
+			}
+			continue
+		}
+		if err := d.adoptVolume(entry); err != nil {
+			klog.Errorf("Failed to re-adopt volume %s mounted at %s: %s", entry.VolumeId, entry.StagingPath, err)
+			continue
+		}
+		klog.Infof("Volume %s mounted at %s has been re-adopted", entry.VolumeId, entry.StagingPath)
+	}
+}
+
+func (d *CSIS3Driver) adoptVolume(entry *journalEntry) error {
+	id, err := volume.Parse(entry.VolumeId)
+	if err != nil {
+		return err
+	}
+	staged, err := adoptedVolume(id, entry)
+	if err != nil {
+		return err
+	}
+
+	mounter.AdoptFuseMount(entry.StagingPath, entry.Options, entry.PID)
+	d.Lock()
+	d.stagedVolumes[entry.VolumeId] = staged
+	d.Unlock()
+	d.updateJournal(entry.VolumeId, (*journalEntry).recordFuseMount)
+	d.supervisor.Watch(entry.VolumeId, entry.StagingPath, staged.mounter)
+	for target, readonly := range entry.Targets {
+		d.supervisor.AddTarget(entry.StagingPath, target, readonly)
+	}
+	return nil
+}
+
+// remounted records the FUSE process remounting the volume.
+func (d *CSIS3Driver) remounted(volumeId string, _ string) {
+	d.updateJournal(volumeId, (*journalEntry).recordFuseMount)
+}
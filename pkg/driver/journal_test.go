@@ -0,0 +1,165 @@
+package driver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/leryn1122/csi-s3/pkg/mounter"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+	"github.com/leryn1122/csi-s3/pkg/volume"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+	defer func(dir string) { journalDir = dir }(journalDir)
+	journalDir = t.TempDir()
+
+	entries := []*journalEntry{
+		{
+			VolumeId:      "v1:rclone:bucket:csi-fs/pvc-a:",
+			StagingPath:   "/staging/a",
+			Targets:       map[string]bool{"/target/a": true},
+			Mounter:       "rclone",
+			Options:       []string{"mount", "remote:bucket/csi-fs/pvc-a"},
+			PID:           42,
+			ReadOnly:      true,
+			MountFlags:    []string{"ro"},
+			Metadata:      &s3.Metadata{BucketName: "bucket", FsPathPrefix: "csi-fs/pvc-a", CapacityBytes: 1},
+			VolumeContext: map[string]string{"mounter": "rclone"},
+			Secrets:       map[string]string{"accessKeyID": "key"},
+		},
+		// The legacy volume ID carries a slash, which must not escape the dir.
+		{VolumeId: "bucket/../pvc-b", StagingPath: "/staging/b", Targets: map[string]bool{}},
+	}
+	for _, entry := range entries {
+		if err := saveJournalEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(journalFile(entry.VolumeId))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(journalFile(entry.VolumeId)) != journalDir || info.Mode().Perm() != 0600 {
+			t.Errorf("journal entry of volume %s is written to %s with mode %s", entry.VolumeId, journalFile(entry.VolumeId), info.Mode())
+		}
+		loaded, err := loadJournalEntry(entry.VolumeId)
+		if err != nil || !reflect.DeepEqual(loaded, entry) {
+			t.Errorf("loadJournalEntry(%s) = %+v, %v, expected %+v", entry.VolumeId, loaded, err, entry)
+		}
+	}
+
+	// The malformed entries and the temporary files of the atomic writes are
+	// left out.
+	for name, content := range map[string]string{"malformed.json": "{", ".entry-0": "{}", "notes.txt": "{}"} {
+		if err := os.WriteFile(filepath.Join(journalDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, err := loadJournalEntries()
+	if err != nil || len(loaded) != len(entries) {
+		t.Errorf("loadJournalEntries() = %d entries, %v, expected %d", len(loaded), err, len(entries))
+	}
+
+	if err = removeJournalEntry(entries[0].VolumeId); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := loadJournalEntry(entries[0].VolumeId); entry != nil || err != nil {
+		t.Errorf("loadJournalEntry of the removed entry = %+v, %v, expected none", entry, err)
+	}
+	if err = removeJournalEntry(entries[0].VolumeId); err != nil {
+		t.Errorf("removeJournalEntry of the removed entry: %v", err)
+	}
+}
+
+func TestOrphanedMounts(t *testing.T) {
+	const stagingDir = "/var/lib/kubelet/plugins/kubernetes.io/csi/io.github.leryn.csi.s3driver/"
+	mounted := map[string]bool{
+		stagingDir + "known/globalmount":   true,
+		stagingDir + "orphan/globalmount":  true,
+		"/var/lib/kubelet/pods/pod/volume": true,
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/io.github.leryn.csi.s3driver-other/globalmount": true,
+	}
+	stagePaths := map[string]bool{stagingDir + "known/globalmount": true}
+	orphans := orphanedMounts(mounted, stagingDir, stagePaths)
+	if expected := []string{stagingDir + "orphan/globalmount"}; !reflect.DeepEqual(orphans, expected) {
+		t.Errorf("orphanedMounts() = %v, expected %v", orphans, expected)
+	}
+}
+
+func TestAdoptVolumeWithoutBackend(t *testing.T) {
+	defer func(dir string) { journalDir = dir }(journalDir)
+	journalDir = t.TempDir()
+
+	// The bucket is unreachable with the keys, e.g. during an outage.
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`<Error><Code>AccessDenied</Code></Error>`))
+	}))
+	defer server.Close()
+	secrets := map[string]string{"endpoint": server.URL, "region": "us-east-1", "accessKeyID": "key", "secretAccessKey": "secret"}
+
+	d, err := NewDriver("node", "unix:///tmp/csi-s3-test.sock", ModeNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		volumeId string
+		metadata *s3.Metadata
+		pending  bool
+		prefix   string
+	}{
+		{"journal with metadata", "v1:rclone:bucket:csi-fs/pvc-a:", &s3.Metadata{BucketName: "bucket", FsPathPrefix: "csi-fs/pvc-a", CapacityBytes: 1}, false, "csi-fs/pvc-a"},
+		{"journal of older versions", "v1:rclone:bucket:csi-fs/pvc-b:", nil, true, "csi-fs/pvc-b"},
+	}
+	for _, c := range cases {
+		requests.Store(0)
+		err := d.adoptVolume(&journalEntry{
+			VolumeId:    c.volumeId,
+			StagingPath: t.TempDir(),
+			Targets:     make(map[string]bool),
+			Mounter:     mounter.RcloneMounterType,
+			Metadata:    c.metadata,
+			Secrets:     secrets,
+		})
+		if err != nil {
+			t.Errorf("%s: adoptVolume failed: %v", c.name, err)
+			continue
+		}
+		staged := d.stagedVolumes[c.volumeId]
+		if staged.metadataPending != c.pending || staged.metadata.BucketName != "bucket" || staged.metadata.FsPathPrefix != c.prefix {
+			t.Errorf("%s: adopted with metadata %+v and pending %v", c.name, staged.metadata, staged.metadataPending)
+		}
+		if c.metadata != nil && requests.Load() != 0 {
+			t.Errorf("%s: adoptVolume reached the bucket %d times", c.name, requests.Load())
+		}
+		if _, err = staged.bucketUsage(); err == nil {
+			t.Errorf("%s: expected the usage to fail without the bucket", c.name)
+		}
+	}
+}
+
+func TestAdoptVolumeWithForeignMetadata(t *testing.T) {
+	secrets := map[string]string{"endpoint": "http://127.0.0.1:9", "region": "us-east-1", "accessKeyID": "key", "secretAccessKey": "secret"}
+	id, err := volume.Parse("v1:rclone:bucket:csi-fs/pvc-a:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The metadata points at the prefix of another volume of the bucket.
+	_, err = adoptedVolume(id, &journalEntry{
+		VolumeId:    id.String(),
+		StagingPath: t.TempDir(),
+		Targets:     make(map[string]bool),
+		Metadata:    &s3.Metadata{BucketName: "bucket", FsPathPrefix: "csi-fs/pvc-b", Mounter: mounter.RcloneMounterType},
+		Secrets:     secrets,
+	})
+	if err == nil {
+		t.Error("adoptedVolume accepted the metadata of another prefix")
+	}
+}
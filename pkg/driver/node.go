@@ -2,28 +2,34 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/leryn1122/csi-s3/pkg/constant"
 	"github.com/leryn1122/csi-s3/pkg/mounter"
-	"github.com/leryn1122/csi-s3/pkg/s3"
+	"github.com/leryn1122/csi-s3/pkg/volume"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"io/fs"
 	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
 	"os"
 )
 
-func (d *CSIS3Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (d *CSIS3Driver) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeId := request.GetVolumeId()
 	stagingTargetPath := request.GetStagingTargetPath()
-	bucket := request.GetSecrets()[constant.BucketKey]
-	klog.Infof("Stage volume where VolumeID: %s, Bucket: %s, Stage path: %s", volumeId, bucket, stagingTargetPath)
+	klog.Infof("Stage volume where VolumeID: %s, Stage path: %s", volumeId, stagingTargetPath)
 
 	// Validation
 	if len(volumeId) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume name missing in request")
 	}
-	if len(bucket) == 0 {
+	id, err := volume.Parse(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found: %s", volumeId, err.Error()))
+	}
+	if len(volumeBucket(id, request.GetSecrets())) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "bucket name count not be empty")
 	}
 	if len(stagingTargetPath) == 0 {
@@ -32,35 +38,90 @@ func (d *CSIS3Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageV
 	if request.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "volume capability must be provided")
 	}
+	if err := d.validateVolumeCapability(request.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The volume is staged read-only for the read-only access modes, so that
+	// no target path can write it.
+	readonly := isReadOnlyAccessMode(request.GetVolumeCapability().GetAccessMode().GetMode())
+
+	state, mountPoint, err := mounter.InspectMount(mount.New(""), stagingTargetPath, "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to check mounted path: %s", err.Error()))
+	}
+	switch state {
+	case mounter.Mounted:
+		if mounter.IsReadOnly(mountPoint) != readonly {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("staging path %s is already mounted with readonly %v", stagingTargetPath, !readonly))
+		}
+		klog.Infof("staging path has been already mounted: %v", stagingTargetPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	case mounter.MountedOther:
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("staging path %s is mounted with a different source", stagingTargetPath))
+	case mounter.Corrupted:
+		klog.Warningf("staging path %s is corrupted, staging it again", stagingTargetPath)
+		if err := mounter.Unmount(stagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to unmount corrupted staging path: %s", err.Error()))
+		}
+	}
 
-	err := os.MkdirAll(stagingTargetPath, 0777)
+	// The journal keeps the resolved CA bundle, so that the volume is recovered
+	// even if the ConfigMap is gone.
+	secrets, err := d.requestSecrets(ctx, request.GetSecrets(), request.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = os.MkdirAll(stagingTargetPath, 0777)
 	if err != nil {
 		if !os.IsExist(err) {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Unable to create mkdir directory for %s error:%s", stagingTargetPath, err))
 		}
 	}
 
-	s3Client, err := s3.NewClientFromSecrets(request.GetSecrets())
+	staged, err := newStagedVolume(id, &journalEntry{
+		VolumeId:      volumeId,
+		StagingPath:   stagingTargetPath,
+		Targets:       make(map[string]bool),
+		ReadOnly:      readonly,
+		MountFlags:    request.GetVolumeCapability().GetMount().GetMountFlags(),
+		VolumeContext: request.GetVolumeContext(),
+		Secrets:       secrets,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %w", err)
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	metadata, err := s3Client.GetMetadata()
+	// The journal entry is written ahead, so that the mount is never unknown to
+	// the garbage collector.
+	d.Lock()
+	err = saveJournalEntry(staged.entry)
+	d.Unlock()
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get metadata: %v", err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to write journal entry: %s", err.Error()))
 	}
-
-	mnt, err := mounter.NewMounter(metadata, s3Client.Config)
-	if mnt == nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to initialize the moutner: %v", metadata.Mounter))
+	if err := staged.mounter.Stage(stagingTargetPath); err != nil {
+		if err := removeJournalEntry(volumeId); err != nil {
+			klog.Warningf("failed to remove journal entry of volume %s: %s", volumeId, err)
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to stage volume: %s", err.Error()))
 	}
-	if err := mnt.Stage(stagingTargetPath); err != nil {
-		return nil, err
+
+	d.Lock()
+	d.stagedVolumes[volumeId] = staged
+	staged.entry.recordFuseMount()
+	err = saveJournalEntry(staged.entry)
+	d.Unlock()
+	if err != nil {
+		klog.Warningf("failed to write journal entry of volume %s: %s", volumeId, err)
 	}
+	d.supervisor.Watch(volumeId, stagingTargetPath, staged.mounter)
+	klog.Infof("S3 volume `%s` has been successfully staged to %s", volumeId, stagingTargetPath)
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (d *CSIS3Driver) NodeUnstageVolume(_ context.Context, request *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+func (d *CSIS3Driver) NodeUnstageVolume(ctx context.Context, request *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	volumeId := request.GetVolumeId()
 	stagingTargetPath := request.GetStagingTargetPath()
 
@@ -73,14 +134,50 @@ func (d *CSIS3Driver) NodeUnstageVolume(_ context.Context, request *csi.NodeUnst
 	}
 
 	klog.Infof("unstage volume where volumeId: %s stage: %s", volumeId, stagingTargetPath)
+
+	d.supervisor.Unwatch(stagingTargetPath)
+
+	// The mounter is only known if the volume is adopted, otherwise whatever is
+	// left at the staging path is unmounted, with the FUSE process recorded in
+	// the journal.
+	d.Lock()
+	staged := d.stagedVolumes[volumeId]
+	d.Unlock()
+	var err error
+	if staged != nil {
+		err = staged.mounter.Unstage(ctx, stagingTargetPath)
+	} else {
+		entry, journalErr := loadJournalEntry(volumeId)
+		if journalErr != nil {
+			klog.Warningf("failed to read journal entry of volume %s: %s", volumeId, journalErr)
+		} else if entry != nil && entry.StagingPath == stagingTargetPath {
+			mounter.AdoptFuseMount(stagingTargetPath, entry.Options, entry.PID)
+		}
+		err = mounter.FuseUmount(ctx, stagingTargetPath)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to unstage volume: %s", err.Error()))
+	}
+
+	d.Lock()
+	delete(d.stagedVolumes, volumeId)
+	err = removeJournalEntry(volumeId)
+	d.Unlock()
+	if err != nil {
+		klog.Warningf("failed to remove journal entry of volume %s: %s", volumeId, err)
+	}
+	if err := mounter.RemoveCredentials(volumeId); err != nil {
+		klog.Warningf("failed to remove credentials of volume %s: %s", volumeId, err)
+	}
+	klog.Infof("S3 volume %s has been unstaged from %s", volumeId, stagingTargetPath)
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (d *CSIS3Driver) NodePublishVolume(_ context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (d *CSIS3Driver) NodePublishVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeId := request.GetVolumeId()
 	targetPath := request.GetTargetPath()
 	stagingTargetPath := request.GetStagingTargetPath()
-	bucketName := request.GetSecrets()[constant.BucketKey]
 
 	// Validation
 	if request.GetVolumeCapability() == nil {
@@ -89,7 +186,11 @@ func (d *CSIS3Driver) NodePublishVolume(_ context.Context, request *csi.NodePubl
 	if len(volumeId) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume name missing in request")
 	}
-	if len(bucketName) == 0 {
+	id, err := volume.Parse(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found: %s", volumeId, err.Error()))
+	}
+	if len(volumeBucket(id, request.GetSecrets())) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "bucket name count not be empty")
 	}
 	if len(stagingTargetPath) == 0 {
@@ -99,14 +200,48 @@ func (d *CSIS3Driver) NodePublishVolume(_ context.Context, request *csi.NodePubl
 		return nil, status.Error(codes.InvalidArgument, "target path missing in request")
 	}
 
+	if err := d.validateVolumeCapability(request.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	readonly := request.GetReadonly() || isReadOnlyAccessMode(request.GetVolumeCapability().GetAccessMode().GetMode())
+
 	// Check mount point
-	isMount, err := mounter.CheckMount(volumeId, targetPath)
+	state, mountPoint, err := mounter.InspectMount(mount.New(""), targetPath, stagingTargetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to check mounted path: %s", err.Error()))
 	}
-	if isMount {
+	switch state {
+	case mounter.Mounted:
+		if mounter.IsReadOnly(mountPoint) != readonly {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("target path %s is already mounted with readonly %v", targetPath, !readonly))
+		}
+		// kubelet calls NodePublishVolume again with the updated secrets, as
+		// the CSIDriver requires republishing.
+		if err := d.rotateSecrets(volumeId, request.GetSecrets()); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 		klog.Infof("target path has been already mounted: %v", targetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
+	case mounter.MountedOther:
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("target path %s is mounted with a different source", targetPath))
+	case mounter.Corrupted:
+		klog.Warningf("target path %s is corrupted, mounting it again", targetPath)
+		if err := mounter.Unmount(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to unmount corrupted target path: %s", err.Error()))
+		}
+	}
+	// The target path is bind-mounted from the staging path, which must be the
+	// FUSE mount of the volume, so that the pod never writes to the node disk.
+	// Neither the bucket nor its credentials are needed then.
+	stagingState, _, err := mounter.InspectMount(mount.New(""), stagingTargetPath, "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to check staging path: %s", err.Error()))
+	}
+	if stagingState != mounter.Mounted {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("staging path %s of volume %s is %s", stagingTargetPath, volumeId, stagingState))
+	}
+	if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to create target path %s: %s", targetPath, err.Error()))
 	}
 
 	deviceId := ""
@@ -114,32 +249,19 @@ func (d *CSIS3Driver) NodePublishVolume(_ context.Context, request *csi.NodePubl
 		deviceId = request.GetPublishContext()[deviceId]
 	}
 
-	readonly := request.GetReadonly()
 	attributes := request.GetVolumeContext()
 	mountFlags := request.GetVolumeCapability().GetMount().GetMountFlags()
 
 	klog.Infof("target = %v\ndevice = %v\nreadonly = %v\nvolumeId = %v\nattributes = %v\nmountFlags = %v\n",
 		targetPath, deviceId, readonly, volumeId, attributes, mountFlags)
 
-	// Mount target path by given `mounter`
-	s3Client, err := s3.NewClientFromSecrets(request.GetSecrets())
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to initialize S3 client: %s", err.Error()))
-	}
-
-	metadata, err := s3Client.GetMetadata()
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get metadata: %s", err.Error()))
-	}
-
-	mnt, err := mounter.NewMounter(metadata, s3Client.Config)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to create mounter: %s", err.Error()))
-	}
-
-	if err = mnt.Mount(stagingTargetPath, targetPath); err != nil {
+	if err = mounter.BindMount(stagingTargetPath, targetPath, readonly); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to mounte path: %s", err.Error()))
 	}
+	d.supervisor.AddTarget(stagingTargetPath, targetPath, readonly)
+	d.updateJournal(volumeId, func(entry *journalEntry) {
+		entry.Targets[targetPath] = readonly
+	})
 	klog.Infof("S3 volume `%s` has been successfully mounted to %s", volumeId, targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -157,35 +279,61 @@ func (d *CSIS3Driver) NodeUnpublishVolume(_ context.Context, request *csi.NodeUn
 		return nil, status.Error(codes.InvalidArgument, "target path missing in request")
 	}
 
-	if err := mounter.FuseUmount(targetPath); err != nil {
+	d.supervisor.RemoveTarget(targetPath)
+	if err := mounter.Unmount(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	d.updateJournal(volumeId, func(entry *journalEntry) {
+		delete(entry.Targets, targetPath)
+	})
 	klog.Infof("S3 volume %s has been unmounted from %s", volumeId, targetPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (d *CSIS3Driver) NodeGetVolumeStats(_ context.Context, request *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	stagingTargetPath := request.GetStagingTargetPath()
-	if len(stagingTargetPath) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	volumeId := request.GetVolumeId()
+	volumePath := request.GetVolumePath()
+
+	// Validation
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume name missing in request")
+	}
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+
+	d.Lock()
+	staged := d.stagedVolumes[volumeId]
+	d.Unlock()
+	if staged == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s is not staged on the node", volumeId))
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("volume path %s does not exist", volumePath))
+		}
+		if mount.IsCorruptedMnt(err) {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: abnormalCondition("mount point %s is stale: %s", volumePath, err.Error()),
+			}, nil
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to statfs %s: %s", volumePath, err.Error()))
+	}
+
+	condition := checkStagedVolume(staged)
+	usage := statfsUsage(&statfs)
+	if usage == nil && !condition.GetAbnormal() {
+		var err error
+		if usage, err = staged.bucketUsage(); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
 	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
-			{
-				Total:     0,
-				Available: 0,
-				Used:      0,
-				Unit:      csi.VolumeUsage_BYTES,
-			},
-			{
-				Total:     0,
-				Available: 0,
-				Used:      0,
-				Unit:      csi.VolumeUsage_INODES,
-			},
-		},
-		VolumeCondition: &csi.VolumeCondition{},
+		Usage:           usage,
+		VolumeCondition: condition,
 	}, nil
 }
 
@@ -206,7 +354,12 @@ func (d *CSIS3Driver) NodeGetInfo(_ context.Context, _ *csi.NodeGetInfoRequest)
 }
 
 func (d *CSIS3Driver) getNodeServiceCapabilities() []*csi.NodeServiceCapability {
+	if !d.Config.IsNode() {
+		return nil
+	}
+
 	cl := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
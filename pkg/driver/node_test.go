@@ -0,0 +1,34 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPublishUnstagedVolume(t *testing.T) {
+	d, err := NewDriver("node", "unix:///tmp/csi-s3-test.sock", ModeNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	// The staging path is a plain directory of the node, e.g. once the FUSE
+	// mount is gone.
+	dir := t.TempDir()
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "v1:rclone:bucket:csi-fs/pvc:",
+		StagingTargetPath: dir,
+		TargetPath:        filepath.Join(dir, "target"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected %s, got %v", codes.FailedPrecondition, err)
+	}
+}
@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+// usageCacheTTL bounds how often the objects under a volume prefix are listed,
+// since kubelet polls the stats of every volume each minute.
+const usageCacheTTL = 5 * time.Minute
+
+type prefixUsage struct {
+	bytes   int64
+	objects int64
+	expires time.Time
+}
+
+// statfsUsage returns the usage reported by the FUSE backend, or nil if the
+// backend does not track it, e.g. s3fs and goofys report fake free blocks.
+func statfsUsage(statfs *unix.Statfs_t) []*csi.VolumeUsage {
+	if statfs.Blocks == 0 || statfs.Blocks == statfs.Bfree {
+		return nil
+	}
+
+	blockSize := int64(statfs.Bsize)
+	usage := []*csi.VolumeUsage{
+		{
+			Total:     int64(statfs.Blocks) * blockSize,
+			Available: int64(statfs.Bavail) * blockSize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+			Unit:      csi.VolumeUsage_BYTES,
+		},
+	}
+	if statfs.Files > 0 {
+		usage = append(usage, &csi.VolumeUsage{
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+			Unit:      csi.VolumeUsage_INODES,
+		})
+	}
+	return usage
+}
+
+// bucketUsage sums the objects under the volume prefix, and compares them
+// against the capacity of the volume.
+func (v *stagedVolume) bucketUsage() ([]*csi.VolumeUsage, error) {
+	v.usageLock.Lock()
+	defer v.usageLock.Unlock()
+
+	if err := v.fetchMetadata(); err != nil {
+		return nil, err
+	}
+	if v.usage == nil || time.Now().After(v.usage.expires) {
+		size, count, err := v.s3Client().PrefixUsage(v.metadata.FsPathPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects under prefix %s: %w", v.metadata.FsPathPrefix, err)
+		}
+		v.usage = &prefixUsage{bytes: size, objects: count, expires: time.Now().Add(usageCacheTTL)}
+	}
+
+	capacity := v.metadata.CapacityBytes
+	return []*csi.VolumeUsage{
+		{
+			Total:     capacity,
+			Available: max(0, capacity-v.usage.bytes),
+			Used:      v.usage.bytes,
+			Unit:      csi.VolumeUsage_BYTES,
+		},
+		{
+			Used: v.usage.objects,
+			Unit: csi.VolumeUsage_INODES,
+		},
+	}, nil
+}
@@ -0,0 +1,242 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+	"github.com/leryn1122/csi-s3/pkg/volume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultBucketTemplate names the dedicated bucket of the volume after the PV.
+const defaultBucketTemplate = "${pv.name}"
+
+// renderBucketName renders the name of the dedicated bucket from the template
+// with `${pvc.name}`, `${pvc.namespace}` and `${pv.name}`, which are taken from
+// the parameters added by the provisioner with `--extra-create-metadata`.
+func renderBucketName(template string, name string, parameters map[string]string) (string, error) {
+	if len(template) == 0 {
+		template = defaultBucketTemplate
+	}
+	pvName := parameters[constant.PVNameKey]
+	if len(pvName) == 0 {
+		pvName = name
+	}
+	for placeholder, value := range map[string]string{
+		"${pvc.name}":      parameters[constant.PVCNameKey],
+		"${pvc.namespace}": parameters[constant.PVCNamespaceKey],
+		"${pv.name}":       pvName,
+	} {
+		if !strings.Contains(template, placeholder) {
+			continue
+		}
+		if len(value) == 0 {
+			return "", fmt.Errorf("%s is unknown, the provisioner must run with `--extra-create-metadata`", placeholder)
+		}
+		template = strings.ReplaceAll(template, placeholder, value)
+	}
+	if strings.Contains(template, "${") {
+		return "", fmt.Errorf("unknown placeholder in bucket name template: %s", template)
+	}
+	return template, nil
+}
+
+// maxPrefixNameLength is the maximum length of the volume name kept in the
+// prefix and the volume ID, so that the volume ID fits into 128 characters.
+const maxPrefixNameLength = 48
+
+// prefixName returns the name of the volume kept in the prefix and the volume
+// ID. The names too long are replaced by their hash.
+func prefixName(name string) string {
+	if len(name) <= maxPrefixNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// volumeBucket returns the bucket where the volume is stored. The bucket of the
+// legacy volume IDs is given by the secrets.
+func volumeBucket(id *volume.ID, secrets map[string]string) string {
+	if len(id.Bucket) != 0 {
+		return id.Bucket
+	}
+	return secrets[constant.BucketKey]
+}
+
+// newVolumeClient creates the S3 client of the bucket where the volume is
+// stored. The bucket of the legacy volume IDs is given by the secrets.
+func newVolumeClient(id *volume.ID, secrets map[string]string) (*s3.S3Client, error) {
+	client, err := s3.NewClientFromSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+	client.Config.Bucket = volumeBucket(id, secrets)
+	if len(id.Mounter) != 0 {
+		client.Config.Mounter = id.Mounter
+	}
+	return client, nil
+}
+
+// checkMetadata validates that the metadata describes the volume with the ID.
+// The volume is located by its ID, so the metadata naming another prefix, e.g.
+// rewritten to take over the data of another volume, is rejected.
+func checkMetadata(id *volume.ID, metadata *s3.Metadata) error {
+	if metadata.FsPathPrefix != id.Prefix {
+		return fmt.Errorf("metadata of volume %s names prefix `%s` instead of `%s`", id, metadata.FsPathPrefix, id.Prefix)
+	}
+	return nil
+}
+
+// parameterSecrets are the connection settings which the volume parameters
+// may give. The client certificate and the LDAP account are left out, as the
+// parameters are public.
+var parameterSecrets = []string{
+	constant.AddressingStyleKey,
+	constant.CABundleKey,
+	constant.CABundleConfigMapKey,
+	constant.InsecureSkipVerifyKey,
+	constant.CredentialProviderKey,
+	constant.CredentialsPathKey,
+	constant.RoleARNKey,
+	constant.RoleSessionNameKey,
+	constant.ExternalIDKey,
+	constant.STSEndpointKey,
+	constant.WebIdentityTokenFileKey,
+}
+
+// ambientSecrets are the settings of the ambient credential providers, which
+// would let the users pick the bucket mounted with the credentials of the
+// driver, the role assumed with its token, or its files read as credentials.
+var ambientSecrets = []string{
+	constant.BucketKey,
+	constant.CredentialsPathKey,
+	constant.WebIdentityTokenFileKey,
+	constant.RoleARNKey,
+	constant.RoleSessionNameKey,
+	constant.STSEndpointKey,
+}
+
+// ephemeralKey is set in the volume context of the inline volumes, whose
+// attributes are given by the pods rather than the StorageClass.
+const ephemeralKey = "csi.storage.k8s.io/ephemeral"
+
+// requestSecrets returns the secrets of the request merged with the volume
+// parameters, with the CA bundle resolved.
+func (d *CSIS3Driver) requestSecrets(ctx context.Context, secrets map[string]string, parameters map[string]string) (map[string]string, error) {
+	if err := d.checkAmbientCredentials(secrets, parameters); err != nil {
+		return nil, err
+	}
+	return d.resolveCABundle(ctx, volumeSecrets(secrets, parameters))
+}
+
+// checkAmbientCredentials validates that the ambient credential providers and
+// their settings come from the parameters of the StorageClass, set by the
+// admins, rather than the secrets, which the StorageClass may take from the
+// namespace of the PVC. Otherwise the users would mount any bucket with the
+// credentials of the driver.
+func (d *CSIS3Driver) checkAmbientCredentials(secrets map[string]string, parameters map[string]string) error {
+	if d.Config.AmbientCredentialsInSecrets {
+		return nil
+	}
+	if parameters[ephemeralKey] == "true" {
+		if provider := parameters[constant.CredentialProviderKey]; s3.IsAmbientProvider(provider) {
+			return fmt.Errorf("credential provider %s is not accepted from the attributes of inline volumes", provider)
+		}
+		parameters = nil
+	}
+	provider, ok := parameters[constant.CredentialProviderKey]
+	if !ok {
+		provider = secrets[constant.CredentialProviderKey]
+		if s3.IsAmbientProvider(provider) {
+			return fmt.Errorf("credential provider %s is only accepted from the parameters of the StorageClass", provider)
+		}
+	}
+	if !s3.IsAmbientProvider(provider) {
+		return nil
+	}
+	for _, key := range ambientSecrets {
+		if _, ok := secrets[key]; !ok {
+			continue
+		}
+		if _, ok := parameters[key]; !ok {
+			return fmt.Errorf("%s of credential provider %s is only accepted from the parameters of the StorageClass", key, provider)
+		}
+	}
+	return nil
+}
+
+// volumeSecrets returns the secrets with the connection settings given by the
+// volume parameters, which override the ones of the secrets. The empty secrets
+// are kept empty, as they tell the bucket is looked up in the backends.
+func volumeSecrets(secrets map[string]string, parameters map[string]string) map[string]string {
+	if len(secrets) == 0 {
+		return secrets
+	}
+	var merged map[string]string
+	for _, key := range parameterSecrets {
+		value, ok := parameters[key]
+		if !ok {
+			continue
+		}
+		if merged == nil {
+			merged = make(map[string]string, len(secrets)+len(parameterSecrets))
+			for key, value := range secrets {
+				merged[key] = value
+			}
+		}
+		merged[key] = value
+	}
+	if merged == nil {
+		return secrets
+	}
+	return merged
+}
+
+// defaultCABundleKey is the key of the CA bundle in the ConfigMap, as used by
+// `kube-root-ca.crt` and trust-manager.
+const defaultCABundleKey = "ca.crt"
+
+// resolveCABundle reads the CA bundle referred to by `caBundleConfigMap` into
+// `caBundle`, so that neither the S3 client nor the mounters, nor the volumes
+// recovered from the journal, need the Kubernetes API.
+func (d *CSIS3Driver) resolveCABundle(ctx context.Context, secrets map[string]string) (map[string]string, error) {
+	reference, ok := secrets[constant.CABundleConfigMapKey]
+	if !ok {
+		return secrets, nil
+	}
+	if len(secrets[constant.CABundleKey]) != 0 {
+		return nil, fmt.Errorf("only one of %s and %s may be given", constant.CABundleKey, constant.CABundleConfigMapKey)
+	}
+	parts := strings.Split(reference, "/")
+	if len(parts) == 2 {
+		parts = append(parts, defaultCABundleKey)
+	}
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return nil, fmt.Errorf("%s must be <namespace>/<name>[/<key>]: %s", constant.CABundleConfigMapKey, reference)
+	}
+	if d.client == nil {
+		return nil, fmt.Errorf("unable to read ConfigMap %s/%s without the Kubernetes API", parts[0], parts[1])
+	}
+	configMap, err := d.client.CoreV1().ConfigMaps(parts[0]).Get(ctx, parts[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ConfigMap %s/%s: %w", parts[0], parts[1], err)
+	}
+	bundle, ok := configMap.Data[parts[2]]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no key %s", parts[0], parts[1], parts[2])
+	}
+
+	resolved := make(map[string]string, len(secrets))
+	for key, value := range secrets {
+		resolved[key] = value
+	}
+	delete(resolved, constant.CABundleConfigMapKey)
+	resolved[constant.CABundleKey] = bundle
+	return resolved, nil
+}
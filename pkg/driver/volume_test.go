@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+)
+
+func TestCheckAmbientCredentials(t *testing.T) {
+	cases := []struct {
+		name       string
+		secrets    map[string]string
+		parameters map[string]string
+		inSecrets  bool
+		expected   bool
+	}{
+		{"static keys", map[string]string{"accessKeyID": "key"}, nil, false, true},
+		{"assumeRole in secrets", map[string]string{constant.CredentialProviderKey: s3.CredentialProviderAssumeRole, constant.RoleARNKey: "role"}, nil, false, true},
+		{"env in secrets", map[string]string{constant.CredentialProviderKey: s3.CredentialProviderEnv}, nil, false, false},
+		{"imds in secrets", map[string]string{constant.CredentialProviderKey: s3.CredentialProviderIMDS}, nil, false, false},
+		{"file in secrets", map[string]string{constant.CredentialProviderKey: s3.CredentialProviderFile, constant.CredentialsPathKey: "/etc"}, nil, false, false},
+		{"env in secrets allowed by the driver", map[string]string{constant.CredentialProviderKey: s3.CredentialProviderEnv}, nil, true, true},
+		{"imds in parameters", map[string]string{"endpoint": "https://s3.amazonaws.com"},
+			map[string]string{constant.CredentialProviderKey: s3.CredentialProviderIMDS}, false, true},
+		{"webIdentity in parameters with role in secrets", map[string]string{constant.RoleARNKey: "role"},
+			map[string]string{constant.CredentialProviderKey: s3.CredentialProviderWebIdentity}, false, false},
+		{"webIdentity in parameters with token file in secrets", map[string]string{constant.WebIdentityTokenFileKey: "/token"},
+			map[string]string{constant.CredentialProviderKey: s3.CredentialProviderWebIdentity}, false, false},
+		{"webIdentity in parameters with role overridden", map[string]string{constant.RoleARNKey: "role"},
+			map[string]string{constant.CredentialProviderKey: s3.CredentialProviderWebIdentity, constant.RoleARNKey: "admin"}, false, true},
+		{"file in parameters with bucket in secrets", map[string]string{constant.BucketKey: "bucket"},
+			map[string]string{constant.CredentialProviderKey: s3.CredentialProviderFile, constant.CredentialsPathKey: "/etc"}, false, false},
+		{"static in parameters overriding env in secrets", map[string]string{constant.CredentialProviderKey: s3.CredentialProviderEnv},
+			map[string]string{constant.CredentialProviderKey: s3.CredentialProviderStatic}, false, true},
+		{"env in inline volume attributes", nil,
+			map[string]string{constant.CredentialProviderKey: s3.CredentialProviderEnv, ephemeralKey: "true"}, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := &CSIS3Driver{Config: Config{AmbientCredentialsInSecrets: c.inSecrets}}
+			if err := d.checkAmbientCredentials(c.secrets, c.parameters); (err == nil) != c.expected {
+				t.Errorf("checkAmbientCredentials(%v, %v) error = %v, expected success %v", c.secrets, c.parameters, err, c.expected)
+			}
+		})
+	}
+}
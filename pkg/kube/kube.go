@@ -32,7 +32,7 @@ func CreateKubeClient() (*kubernetes.Clientset, error) {
 func IsInKubernetesCluster() bool {
 	exist, err := support.CheckPathExist(kubernetesServiceaccountDirname)
 	if err != nil {
-		klog.Info("Failed to check path %s exists or not: %s", kubernetesServiceaccountDirname, err.Error())
+		klog.Infof("Failed to check path %s exists or not: %s", kubernetesServiceaccountDirname, err.Error())
 	}
 	return exist
 }
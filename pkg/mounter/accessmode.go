@@ -0,0 +1,51 @@
+package mounter
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// AccessModeSupport tells how a mounter supports an access mode.
+type AccessModeSupport int
+
+const (
+	// AccessModeUnsupported means the mounter must not serve the access mode.
+	AccessModeUnsupported AccessModeSupport = iota
+	// AccessModeSupported means the mounter serves the access mode safely.
+	AccessModeSupported
+	// AccessModeUnsafe means the mounter serves the access mode without any
+	// consistency guarantee: the writers on different nodes see the changes of
+	// each other late, and the last one to upload an object wins.
+	AccessModeUnsafe
+)
+
+// multiNodeWriterSupport declares how every mounter supports the writers on
+// several nodes, which share the bucket without any locking.
+var multiNodeWriterSupport = map[string]func(options VolumeOptions) AccessModeSupport{
+	// s3fs uploads a file once it is flushed.
+	S3fsMounterType: func(VolumeOptions) AccessModeSupport { return AccessModeUnsafe },
+	// goofys uploads a file once it is closed, and never rewrites it in place.
+	GoofysMounterType: func(VolumeOptions) AccessModeSupport { return AccessModeUnsafe },
+	RcloneMounterType: rcloneMultiNodeWriterSupport,
+}
+
+// AccessModeSupportOf returns how the mounter supports the access mode with the
+// volume options. All mounters serve the writers of a single node and the
+// readers of any node.
+func AccessModeSupportOf(mounterType string, options VolumeOptions, mode csi.VolumeCapability_AccessMode_Mode) AccessModeSupport {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return AccessModeSupported
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		support, ok := multiNodeWriterSupport[mounterType]
+		if !ok {
+			// The unknown mounter falls back to s3fs, see NewMounter.
+			support = multiNodeWriterSupport[S3fsMounterType]
+		}
+		return support(options)
+	}
+	return AccessModeUnsupported
+}
@@ -0,0 +1,30 @@
+package mounter
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestAccessModeSupportOf(t *testing.T) {
+	cases := []struct {
+		mounter    string
+		parameters map[string]string
+		mode       csi.VolumeCapability_AccessMode_Mode
+		expected   AccessModeSupport
+	}{
+		{S3fsMounterType, nil, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, AccessModeSupported},
+		{GoofysMounterType, nil, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, AccessModeSupported},
+		{S3fsMounterType, nil, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, AccessModeUnsafe},
+		{"unknown", nil, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, AccessModeUnsafe},
+		{RcloneMounterType, map[string]string{"vfsCacheMode": "off"}, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, AccessModeUnsafe},
+		{RcloneMounterType, map[string]string{"vfsCacheMode": "writes"}, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, AccessModeUnsupported},
+		{RcloneMounterType, map[string]string{"rclone.options/vfs-cache-mode": "full"}, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, AccessModeUnsupported},
+		{RcloneMounterType, nil, csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, AccessModeUnsupported},
+	}
+	for _, c := range cases {
+		if support := AccessModeSupportOf(c.mounter, VolumeOptions{Parameters: c.parameters}, c.mode); support != c.expected {
+			t.Errorf("AccessModeSupportOf(%s, %v, %s) = %d, expected %d", c.mounter, c.parameters, c.mode, support, c.expected)
+		}
+	}
+}
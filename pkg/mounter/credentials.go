@@ -0,0 +1,321 @@
+package mounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	awsConfigFile = "aws-config"
+	// awsProcessCredentialsFile holds the keys in the output format of
+	// `credential_process`, which the AWS SDKs run again once they expire.
+	awsProcessCredentialsFile = "aws-credentials.json"
+	// awsProfile assumes the role with the keys of awsSourceProfile, if any.
+	awsProfile       = "csi-s3"
+	awsSourceProfile = "csi-s3-source"
+)
+
+// CredentialsRefreshInterval is the interval between the refreshes of the
+// credential files of the staged volumes on the node.
+const CredentialsRefreshInterval = time.Minute
+
+// credentialsLifetime is the expiry of the temporary keys handed to the AWS
+// SDKs whose session token tells none, after which they read the rotated ones.
+// It is extended on every refresh.
+const credentialsLifetime = 5 * CredentialsRefreshInterval
+
+// credentialsDir holds the per-volume credential files consumed by the FUSE
+// processes.
+var credentialsDir = filepath.Join(constant.PluginDir, "credentials")
+
+func volumeCredentialsDir(volumeId string) string {
+	return filepath.Join(credentialsDir, url.PathEscape(volumeId))
+}
+
+// writeCredentialsFile writes the credential file of the volume with 0600 and
+// returns its path. The file is replaced atomically, so a running FUSE process
+// never reads a partially written file.
+func writeCredentialsFile(volumeId string, name string, content string) (string, error) {
+	dir := volumeCredentialsDir(volumeId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(dir, "."+name+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+
+	if err = file.Chmod(0600); err != nil {
+		file.Close()
+		return "", err
+	}
+	if _, err = file.WriteString(content); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err = file.Close(); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	if err = os.Rename(file.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// ValidateCredentials validates that the mounter supports the credential
+// provider. rclone and goofys fetch and refresh the temporary credentials by
+// themselves where their SDKs are able to, and take the ones fetched by the
+// driver otherwise.
+func ValidateCredentials(mounterType string, config *s3.Config) error {
+	if err := ValidateSessionToken(mounterType, config); err != nil {
+		return err
+	}
+	provider := config.Credentials.Provider
+	switch provider {
+	case "", s3.CredentialProviderStatic, s3.CredentialProviderEnv, s3.CredentialProviderFile, s3.CredentialProviderIMDS:
+		return nil
+	case s3.CredentialProviderWebIdentity, s3.CredentialProviderAssumeRole, s3.CredentialProviderLDAP:
+		// s3fs reads the keys only once it starts, so the temporary ones would
+		// expire while it runs.
+		if mounterType == S3fsMounterType {
+			break
+		}
+		if fetchesKeys(mounterType, config) {
+			return nil
+		}
+		// The settings are written into the AWS shared config.
+		for _, value := range []string{config.Credentials.RoleARN, config.Credentials.RoleSessionName, config.Credentials.ExternalID} {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("invalid credentials of provider %s", provider)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("mounter %s supports no credential provider %s", mounterType, provider)
+}
+
+// fetchesKeys reports whether the driver fetches the temporary keys for the
+// mounter, as its SDK is unable to. The SDKs know no LDAP, goofys only reaches
+// AWS STS, and the token file of the driver is not visible to the units of the
+// host.
+func fetchesKeys(mounterType string, config *s3.Config) bool {
+	if mounterType == S3fsMounterType {
+		return false
+	}
+	switch config.Credentials.Provider {
+	case s3.CredentialProviderLDAP:
+		return true
+	case s3.CredentialProviderWebIdentity:
+		return launcher == LauncherSystemd || mounterType == GoofysMounterType && !config.UsesAWSSTS()
+	case s3.CredentialProviderAssumeRole:
+		return mounterType == GoofysMounterType && !config.UsesAWSSTS()
+	}
+	return false
+}
+
+// MounterConfig returns the config handed to the mounter. It holds the keys
+// fetched by the driver as static ones if the mounter is unable to fetch them,
+// which are written to its `credential_process` file on every refresh.
+func MounterConfig(mounterType string, client *s3.S3Client) (*s3.Config, error) {
+	if !fetchesKeys(mounterType, client.Config) {
+		return client.Config, nil
+	}
+	return client.FetchedConfig()
+}
+
+// ValidateSessionToken validates that the mounter takes temporary keys. s3fs
+// reads the keys only once it starts, so they would expire while it runs.
+func ValidateSessionToken(mounterType string, config *s3.Config) error {
+	if mounterType == S3fsMounterType && len(config.SessionToken) != 0 {
+		return fmt.Errorf("mounter %s supports no %s, as it never reads the rotated keys", mounterType, constant.SessionTokenKey)
+	}
+	return nil
+}
+
+// volumeKeys are the keys handed to the FUSE process.
+type volumeKeys struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+func keysOf(config *s3.Config) volumeKeys {
+	return volumeKeys{
+		accessKeyID:     config.AccessKeyID,
+		secretAccessKey: config.SecretAccessKey,
+		sessionToken:    config.SessionToken,
+	}
+}
+
+// rotatingKeys hold the keys of a mounter, which are replaced once they are
+// rotated while the volume stays mounted.
+type rotatingKeys struct {
+	lock sync.Mutex
+	keys volumeKeys
+}
+
+func (rotating *rotatingKeys) get() volumeKeys {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+	return rotating.keys
+}
+
+func (rotating *rotatingKeys) set(keys volumeKeys) {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+	rotating.keys = keys
+}
+
+// writeProcessCredentials writes the keys in the output format of
+// `credential_process`, and returns the command printing them. The static keys
+// never expire, so the AWS SDKs keep them until the process is restarted. The
+// temporary ones expire with their session token, after which the SDKs read
+// the ones fetched again.
+func writeProcessCredentials(volumeId string, keys volumeKeys) (string, error) {
+	var expiration *time.Time
+	if len(keys.sessionToken) != 0 {
+		expiry, ok := s3.SessionTokenExpiry(keys.sessionToken)
+		if !ok {
+			expiry = time.Now().Add(credentialsLifetime)
+		}
+		expiry = expiry.UTC()
+		expiration = &expiry
+	}
+	content, err := json.Marshal(struct {
+		Version         int
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string     `json:",omitempty"`
+		Expiration      *time.Time `json:",omitempty"`
+	}{
+		Version:         1,
+		AccessKeyId:     keys.accessKeyID,
+		SecretAccessKey: keys.secretAccessKey,
+		SessionToken:    keys.sessionToken,
+		Expiration:      expiration,
+	})
+	if err != nil {
+		return "", err
+	}
+	path, err := writeCredentialsFile(volumeId, awsProcessCredentialsFile, string(content))
+	if err != nil {
+		return "", err
+	}
+	// The path is escaped by volumeCredentialsDir, quotes included.
+	return fmt.Sprintf("cat '%s'", path), nil
+}
+
+// awsProviderEnvs returns the environment of the AWS SDKs of rclone and goofys
+// to take the keys, or to fetch the temporary credentials of the provider,
+// which they refresh by themselves. The temporary keys are read by
+// `credential_process` again once they expire, so the rotated ones are taken
+// without remounting.
+// The instance metadata is used once no other one is given.
+func awsProviderEnvs(volumeId string, keys volumeKeys, credentials s3.CredentialsConfig) ([]string, error) {
+	var profile string
+	switch credentials.Provider {
+	case s3.CredentialProviderIMDS:
+		return nil, nil
+	case s3.CredentialProviderWebIdentity:
+		envs := []string{
+			"AWS_ROLE_ARN=" + credentials.RoleARN,
+			"AWS_WEB_IDENTITY_TOKEN_FILE=" + credentials.WebIdentityTokenFile,
+		}
+		if len(credentials.RoleSessionName) != 0 {
+			envs = append(envs, "AWS_ROLE_SESSION_NAME="+credentials.RoleSessionName)
+		}
+		return envs, nil
+	case s3.CredentialProviderAssumeRole:
+		process, err := writeProcessCredentials(volumeId, keys)
+		if err != nil {
+			return nil, err
+		}
+		profile = fmt.Sprintf("[profile %s]\ncredential_process = %s\n", awsSourceProfile, process)
+		profile += fmt.Sprintf("[profile %s]\nrole_arn = %s\nsource_profile = %s\n", awsProfile, credentials.RoleARN, awsSourceProfile)
+		if len(credentials.ExternalID) != 0 {
+			profile += fmt.Sprintf("external_id = %s\n", credentials.ExternalID)
+		}
+		if len(credentials.RoleSessionName) != 0 {
+			profile += fmt.Sprintf("role_session_name = %s\n", credentials.RoleSessionName)
+		}
+	default:
+		process, err := writeProcessCredentials(volumeId, keys)
+		if err != nil {
+			return nil, err
+		}
+		profile = fmt.Sprintf("[profile %s]\ncredential_process = %s\n", awsProfile, process)
+	}
+	configFile, err := writeCredentialsFile(volumeId, awsConfigFile, profile)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"AWS_SDK_LOAD_CONFIG=1",
+		"AWS_CONFIG_FILE=" + configFile,
+		"AWS_PROFILE=" + awsProfile,
+	}, nil
+}
+
+// RemoveCredentials removes all the credential files written for the volume.
+func RemoveCredentials(volumeId string) error {
+	return os.RemoveAll(volumeCredentialsDir(volumeId))
+}
+
+// CleanupCredentials removes the credential files of the volumes not in
+// volumeIds, and the environment files of the units not mounting any path in
+// stagePaths.
+func CleanupCredentials(volumeIds map[string]bool, stagePaths map[string]bool) error {
+	entries, err := os.ReadDir(credentialsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		volumeId, err := url.PathUnescape(entry.Name())
+		if !entry.IsDir() || entry.Name() == filepath.Base(unitEnvDir) || err != nil || volumeIds[volumeId] {
+			continue
+		}
+		klog.Infof("Remove orphaned credentials of volume %s", volumeId)
+		if err = RemoveCredentials(volumeId); err != nil {
+			return err
+		}
+	}
+
+	envFiles := make(map[string]bool)
+	for path := range stagePaths {
+		envFiles[unitEnvFile(path)] = true
+	}
+	entries, err = os.ReadDir(unitEnvDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		envFile := filepath.Join(unitEnvDir, entry.Name())
+		if envFiles[envFile] {
+			continue
+		}
+		klog.Infof("Remove orphaned environment file %s", envFile)
+		if err = os.Remove(envFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
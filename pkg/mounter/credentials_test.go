@@ -0,0 +1,208 @@
+package mounter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/leryn1122/csi-s3/pkg/s3"
+)
+
+func TestValidateCredentials(t *testing.T) {
+	const minio, aws = "http://127.0.0.1:9000", "https://s3.amazonaws.com"
+	cases := []struct {
+		mounter  string
+		endpoint string
+		provider string
+		expected bool
+	}{
+		{S3fsMounterType, minio, s3.CredentialProviderStatic, true},
+		{S3fsMounterType, aws, s3.CredentialProviderIMDS, true},
+		{S3fsMounterType, aws, s3.CredentialProviderWebIdentity, false},
+		{S3fsMounterType, aws, s3.CredentialProviderAssumeRole, false},
+		{RcloneMounterType, minio, s3.CredentialProviderWebIdentity, true},
+		{RcloneMounterType, minio, s3.CredentialProviderAssumeRole, true},
+		{RcloneMounterType, minio, s3.CredentialProviderLDAP, true},
+		{S3fsMounterType, minio, s3.CredentialProviderLDAP, false},
+		{GoofysMounterType, aws, s3.CredentialProviderAssumeRole, true},
+		{GoofysMounterType, minio, s3.CredentialProviderAssumeRole, true},
+		{GoofysMounterType, minio, s3.CredentialProviderWebIdentity, true},
+		{GoofysMounterType, minio, s3.CredentialProviderEnv, true},
+		{S3fsMounterType, minio, s3.CredentialProviderFile, true},
+	}
+	for _, c := range cases {
+		config := &s3.Config{Endpoint: c.endpoint, Credentials: s3.CredentialsConfig{Provider: c.provider}}
+		if err := ValidateCredentials(c.mounter, config); (err == nil) != c.expected {
+			t.Errorf("ValidateCredentials(%s, %s at %s) error = %v, expected success %v", c.mounter, c.provider, c.endpoint, err, c.expected)
+		}
+	}
+}
+
+func TestMounterConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithLDAPIdentity" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`<AssumeRoleWithLDAPIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleWithLDAPIdentityResult><Credentials><AccessKeyId>ldap-key</AccessKeyId><SecretAccessKey>ldap-secret</SecretAccessKey>
+<SessionToken>ldap-token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleWithLDAPIdentityResult>
+</AssumeRoleWithLDAPIdentityResponse>`))
+	}))
+	defer server.Close()
+	client, err := s3.NewClientFromSecrets(map[string]string{
+		"endpoint":                     server.URL,
+		constant.CredentialProviderKey: s3.CredentialProviderLDAP,
+		constant.LDAPUsernameKey:       "user",
+		constant.LDAPPasswordKey:       "password",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := MounterConfig(RcloneMounterType, client)
+	if err != nil {
+		t.Fatalf("MounterConfig failed: %v", err)
+	}
+	if config.AccessKeyID != "ldap-key" || config.SecretAccessKey != "ldap-secret" || config.SessionToken != "ldap-token" ||
+		config.Credentials.Provider != s3.CredentialProviderStatic {
+		t.Errorf("MounterConfig = %+v, expected the keys fetched from MinIO STS", config)
+	}
+	if err = ValidateCredentials(RcloneMounterType, config); err != nil {
+		t.Errorf("ValidateCredentials of the fetched keys error = %v", err)
+	}
+	if config, err = MounterConfig(S3fsMounterType, client); err != nil || config != client.Config {
+		t.Errorf("MounterConfig(%s) = %+v, %v, expected the config of the client", S3fsMounterType, config, err)
+	}
+}
+
+func TestValidateSessionToken(t *testing.T) {
+	for mounter, expected := range map[string]bool{S3fsMounterType: false, RcloneMounterType: true, GoofysMounterType: true} {
+		config := &s3.Config{Endpoint: "http://127.0.0.1:9000", AccessKeyID: "key", SecretAccessKey: "secret", SessionToken: "token"}
+		if err := ValidateSessionToken(mounter, config); (err == nil) != expected {
+			t.Errorf("ValidateSessionToken(%s) error = %v, expected success %v", mounter, err, expected)
+		}
+		config.SessionToken = ""
+		if err := ValidateSessionToken(mounter, config); err != nil {
+			t.Errorf("ValidateSessionToken(%s) without session token error = %v", mounter, err)
+		}
+	}
+}
+
+func TestUpdateCredentials(t *testing.T) {
+	defer func(dir string) { credentialsDir = dir }(credentialsDir)
+	credentialsDir = t.TempDir()
+	config := &s3.Config{Endpoint: "http://127.0.0.1:9000", AccessKeyID: "key", SecretAccessKey: "secret"}
+	mounter, err := NewMounter("volume", &s3.Metadata{Mounter: RcloneMounterType}, config, VolumeOptions{})
+	if err != nil {
+		t.Fatalf("NewMounter failed: %v", err)
+	}
+
+	rotated := &s3.Config{Endpoint: config.Endpoint, AccessKeyID: "rotated-key", SecretAccessKey: "rotated-secret", SessionToken: "token"}
+	if err = mounter.UpdateCredentials(rotated); err != nil {
+		t.Fatalf("UpdateCredentials failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(volumeCredentialsDir("volume"), awsProcessCredentialsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys struct {
+		Version         int
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      time.Time
+	}
+	if err = json.Unmarshal(content, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if keys.Version != 1 || keys.AccessKeyId != "rotated-key" || keys.SecretAccessKey != "rotated-secret" || keys.SessionToken != "token" {
+		t.Errorf("process credentials = %s, expected the rotated keys", content)
+	}
+	if !keys.Expiration.After(time.Now()) {
+		t.Errorf("process credentials expire at %s, expected in the future", keys.Expiration)
+	}
+}
+
+func TestProcessCredentialsExpiration(t *testing.T) {
+	defer func(dir string) { credentialsDir = dir }(credentialsDir)
+	credentialsDir = t.TempDir()
+	exp := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	jwt := "eyJhbGciOiJIUzUxMiJ9." + base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix()))) + ".signature"
+	cases := []struct {
+		name         string
+		sessionToken string
+		expected     func(expiration *time.Time) bool
+	}{
+		{"static keys", "", func(expiration *time.Time) bool { return expiration == nil }},
+		{"MinIO STS", jwt, func(expiration *time.Time) bool { return expiration != nil && expiration.Equal(exp) }},
+		{"opaque token", "opaque", func(expiration *time.Time) bool {
+			return expiration != nil && expiration.After(time.Now()) && expiration.Before(time.Now().Add(credentialsLifetime+time.Minute))
+		}},
+	}
+	for _, c := range cases {
+		if _, err := writeProcessCredentials("volume", volumeKeys{accessKeyID: "key", secretAccessKey: "secret", sessionToken: c.sessionToken}); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filepath.Join(volumeCredentialsDir("volume"), awsProcessCredentialsFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys struct {
+			Expiration *time.Time
+		}
+		if err = json.Unmarshal(content, &keys); err != nil {
+			t.Fatal(err)
+		}
+		if !c.expected(keys.Expiration) {
+			t.Errorf("process credentials of %s = %s, unexpected expiration", c.name, content)
+		}
+	}
+}
+
+func TestCleanupCredentials(t *testing.T) {
+	defer func(dir, units string) { credentialsDir, unitEnvDir = dir, units }(credentialsDir, unitEnvDir)
+	credentialsDir = t.TempDir()
+	unitEnvDir = filepath.Join(credentialsDir, "units")
+
+	volumes := map[string]bool{"v1:rclone:bucket:csi-fs/known:": true, "v1:rclone:bucket:csi-fs/orphan:": false, "bucket/legacy": true}
+	for volumeId := range volumes {
+		if _, err := writeCredentialsFile(volumeId, awsConfigFile, "[profile csi-s3]"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stagePaths := map[string]bool{"/staging/known": true, "/staging/legacy": true}
+	for _, path := range []string{"/staging/known", "/staging/orphan"} {
+		if err := writeEnvFile(unitEnvFile(path), []string{"AWS_PROFILE=csi-s3"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	known := make(map[string]bool)
+	for volumeId, keep := range volumes {
+		if keep {
+			known[volumeId] = true
+		}
+	}
+	if err := CleanupCredentials(known, stagePaths); err != nil {
+		t.Fatalf("CleanupCredentials failed: %v", err)
+	}
+	for volumeId, keep := range volumes {
+		if _, err := os.Stat(volumeCredentialsDir(volumeId)); (err == nil) != keep {
+			t.Errorf("credentials of volume %s exist: %v, expected %v", volumeId, err == nil, keep)
+		}
+	}
+	for path, keep := range map[string]bool{"/staging/known": true, "/staging/orphan": false} {
+		if _, err := os.Stat(unitEnvFile(path)); (err == nil) != keep {
+			t.Errorf("environment file of %s exists: %v, expected %v", path, err == nil, keep)
+		}
+	}
+}
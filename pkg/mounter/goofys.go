@@ -1,24 +1,199 @@
 package mounter
 
-import "github.com/leryn1122/csi-s3/pkg/s3"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/leryn1122/csi-s3/pkg/s3"
+)
 
 const goofysCmd = "goofys"
 
+// goofysParameters maps the volume parameters to the goofys flags.
+var goofysParameters = map[string]string{
+	"statCacheTTL": "stat-cache-ttl",
+	"typeCacheTTL": "type-cache-ttl",
+	"uid":          "uid",
+	"gid":          "gid",
+	"dirMode":      "dir-mode",
+	"fileMode":     "file-mode",
+}
+
+// goofysAllowedOptions are the goofys flags given by users, and whether they
+// take a value. The ones naming hosts or files, e.g. `--endpoint`, are left out.
+var goofysAllowedOptions = map[string]bool{
+	"stat-cache-ttl":  true,
+	"type-cache-ttl":  true,
+	"http-timeout":    true,
+	"uid":             true,
+	"gid":             true,
+	"dir-mode":        true,
+	"file-mode":       true,
+	"cheap":           false,
+	"no-implicit-dir": false,
+	"storage-class":   true,
+	"acl":             true,
+	"sse":             false,
+	"sse-kms":         true,
+}
+
+// goofysOptionValidators validate the values of the goofys flags, which goofys
+// would otherwise reject only once it is launched.
+var goofysOptionValidators = map[string]func(value string) error{
+	"stat-cache-ttl": validateDuration,
+	"type-cache-ttl": validateDuration,
+	"http-timeout":   validateDuration,
+	"uid":            func(value string) error { _, err := strconv.ParseUint(value, 10, 32); return err },
+	"gid":            func(value string) error { _, err := strconv.ParseUint(value, 10, 32); return err },
+	"dir-mode":       func(value string) error { _, err := strconv.ParseUint(value, 8, 32); return err },
+	"file-mode":      func(value string) error { _, err := strconv.ParseUint(value, 8, 32); return err },
+}
+
+func validateDuration(value string) error {
+	_, err := time.ParseDuration(value)
+	return err
+}
+
 type goofysMounter struct {
+	volumeId    string
+	metadata    *s3.Metadata
+	url         string
+	region      string
+	keys        rotatingKeys
+	options     mountOptions
+	readonly    bool
+	pathStyle   bool
+	caBundle    string
+	credentials s3.CredentialsConfig
+}
+
+func newGoofysMounter(volumeId string, metadata *s3.Metadata, config *s3.Config, volumeOptions VolumeOptions) (Mounter, error) {
+	if err := ValidateTLS(GoofysMounterType, config.TLS); err != nil {
+		return nil, err
+	}
+	if err := ValidateCredentials(GoofysMounterType, config); err != nil {
+		return nil, err
+	}
+	options, err := goofysOptions(volumeOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &goofysMounter{
+		volumeId:    volumeId,
+		metadata:    metadata,
+		url:         config.Endpoint,
+		region:      config.Region,
+		keys:        rotatingKeys{keys: keysOf(config)},
+		options:     options,
+		readonly:    volumeOptions.ReadOnly,
+		pathStyle:   config.UsePathStyle(),
+		caBundle:    config.TLS.CABundle,
+		credentials: config.Credentials,
+	}, nil
+}
+
+func goofysOptions(volumeOptions VolumeOptions) (mountOptions, error) {
+	var defaults mountOptions
+	var keys []string
+	for key := range volumeOptions.Parameters {
+		if _, ok := goofysParameters[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, value := goofysParameters[key], volumeOptions.Parameters[key]
+		if len(value) == 0 {
+			continue
+		}
+		if err := validateMountOption(GoofysMounterType, goofysAllowedOptions, name, value); err != nil {
+			return nil, err
+		}
+		defaults = defaults.set(name, value)
+	}
+	options, err := buildMountOptions(GoofysMounterType, goofysAllowedOptions, defaults, volumeOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		validate, ok := goofysOptionValidators[option.name]
+		if !ok {
+			continue
+		}
+		if err := validate(option.value); err != nil {
+			return nil, fmt.Errorf("invalid goofys option %s: %s", option.name, option.value)
+		}
+	}
+	return options, nil
+}
+
+func (goofys *goofysMounter) Stage(stagePath string) error {
+	files, err := writeTLSFiles(goofys.volumeId, s3.TLSConfig{CABundle: goofys.caBundle})
+	if err != nil {
+		return err
+	}
+	envs, err := goofys.envs(files)
+	if err != nil {
+		return err
+	}
+	return fuseMount(stagePath, goofysCmd, goofys.args(stagePath), envs)
+}
+
+func (goofys *goofysMounter) args(stagePath string) []string {
+	args := []string{
+		"--endpoint", goofys.url,
+		"-o", "allow_other",
+	}
+	if goofys.readonly {
+		args = append(args, "-o", "ro")
+	}
+	if len(goofys.region) != 0 {
+		args = append(args, "--region", goofys.region)
+	}
+	// goofys addresses the bucket in path style unless `--subdomain` is given.
+	if !goofys.pathStyle {
+		args = append(args, "--subdomain")
+	}
+	for _, option := range goofys.options {
+		args = append(args, "--"+option.name)
+		if len(option.value) != 0 {
+			args = append(args, option.value)
+		}
+	}
+	return append(args,
+		fmt.Sprintf("%s:%s", goofys.metadata.BucketName, goofys.metadata.FsPathPrefix),
+		stagePath,
+	)
 }
 
-func newGoofysMounter(metadata *s3.Metadata, config *s3.Config) (Mounter, error) {
-	return &goofysMounter{}, nil
+func (goofys *goofysMounter) Unstage(ctx context.Context, stagePath string) error {
+	return FuseUmount(ctx, stagePath)
 }
 
-func (goofys *goofysMounter) Stage(stageTarget string) error {
-	panic("unimplemented")
+func (goofys *goofysMounter) Mount(source string, target string, readonly bool) error {
+	return BindMount(source, target, readonly)
 }
 
-func (goofys *goofysMounter) Unstage(stageTarget string) error {
-	panic("unimplemented")
+func (goofys *goofysMounter) UpdateCredentials(config *s3.Config) error {
+	goofys.keys.set(keysOf(config))
+	_, err := awsProviderEnvs(goofys.volumeId, goofys.keys.get(), goofys.credentials)
+	return err
 }
 
-func (goofys *goofysMounter) Mount(source string, target string) error {
-	panic("unimplemented")
+// envs passes the credentials to goofys through the AWS SDK environment, so
+// that they never appear on the command line. The credentials are taken by
+// the AWS SDK of goofys. The CA bundle replaces the system CAs through
+// `SSL_CERT_FILE`, which Go honors.
+func (goofys *goofysMounter) envs(files tlsFiles) ([]string, error) {
+	envs, err := awsProviderEnvs(goofys.volumeId, goofys.keys.get(), goofys.credentials)
+	if err != nil {
+		return nil, err
+	}
+	if len(files.caBundle) != 0 {
+		envs = append(envs, "SSL_CERT_FILE="+files.caBundle)
+	}
+	return envs, nil
 }
@@ -0,0 +1,219 @@
+package mounter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"k8s.io/klog/v2"
+)
+
+// Launchers start the FUSE processes.
+//
+// The direct launcher runs them as children of the driver, so they die with
+// the plugin container. The systemd-run launcher runs them as transient units
+// of the host systemd, so they outlive the driver, e.g. during upgrades. It
+// requires `/run/systemd` of the host, and FUSE binaries able to run on the
+// host, as they are copied into the plugin dir.
+const (
+	LauncherDirect  = "direct"
+	LauncherSystemd = "systemd-run"
+)
+
+const systemdRunCmd = "systemd-run"
+
+var (
+	launcher = LauncherDirect
+	// hostBinDir holds the FUSE binaries copied for the host.
+	hostBinDir = filepath.Join(constant.PluginDir, "bin")
+	// unitEnvDir holds the environment files of the transient units.
+	unitEnvDir = filepath.Join(credentialsDir, "units")
+)
+
+// SetLauncher sets the launcher of the FUSE processes.
+func SetLauncher(name string) error {
+	switch name {
+	case LauncherDirect:
+	case LauncherSystemd:
+		if _, err := exec.LookPath(systemdRunCmd); err != nil {
+			return fmt.Errorf("launcher %s requires %s: %w", name, systemdRunCmd, err)
+		}
+		klog.Warningf("Launcher %s rejects the volumes with mounter %s, whose binary is dynamically linked", name, S3fsMounterType)
+	default:
+		return fmt.Errorf("unknown launcher %s, expected one of %s and %s", name, LauncherDirect, LauncherSystemd)
+	}
+	launcher = name
+	return nil
+}
+
+// validateLauncher validates that the launcher runs the FUSE binary of the
+// mounter. The copy of s3fs is dynamically linked, so it rarely finds its
+// libraries on the host.
+func validateLauncher(mounterType string) error {
+	if launcher == LauncherSystemd && mounterType == S3fsMounterType {
+		return fmt.Errorf("mounter %s is dynamically linked, so it is unsupported by launcher %s", mounterType, launcher)
+	}
+	return nil
+}
+
+// driverCredentialEnvs are the keys of the environment of the driver, which
+// the AWS SDKs and s3fs would prefer over the ones of the volume.
+var driverCredentialEnvs = map[string]bool{
+	"AWS_ACCESS_KEY_ID":     true,
+	"AWS_ACCESS_KEY":        true,
+	"AWS_SECRET_ACCESS_KEY": true,
+	"AWS_SECRET_KEY":        true,
+	"AWS_SESSION_TOKEN":     true,
+	"AWSACCESSKEYID":        true,
+	"AWSSECRETACCESSKEY":    true,
+	"AWSSESSIONTOKEN":       true,
+}
+
+// launch starts the FUSE process mounting the path with the launcher.
+func launch(path string, command string, args []string, envs []string) ([]byte, error) {
+	if launcher == LauncherSystemd {
+		return systemdLaunch(path, command, args, envs)
+	}
+	cmd := exec.Command(command, args...)
+	for _, env := range os.Environ() {
+		if name, _, _ := strings.Cut(env, "="); !driverCredentialEnvs[name] {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env, envs...)
+	return cmd.CombinedOutput()
+}
+
+// unitName names the transient unit of the FUSE process mounting the path.
+func unitName(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return "csi-s3-" + hex.EncodeToString(sum[:8])
+}
+
+func unitEnvFile(path string) string {
+	return filepath.Join(unitEnvDir, unitName(path)+".env")
+}
+
+// systemdLaunch runs the FUSE process as a transient service of the host
+// systemd. The FUSE binaries fork into the background, so the service is of
+// type forking. The environment may carry credentials, so it is passed by a
+// file only readable by root rather than the command line.
+func systemdLaunch(path string, command string, args []string, envs []string) ([]byte, error) {
+	binary, err := hostBinary(command)
+	if err != nil {
+		return nil, err
+	}
+	envFile := unitEnvFile(path)
+	if err = writeEnvFile(envFile, envs); err != nil {
+		return nil, err
+	}
+
+	unit := unitName(path)
+	// A unit of the same name is left if the previous FUSE process failed.
+	_ = exec.Command("systemctl", "reset-failed", unit).Run()
+
+	runArgs := []string{
+		"--unit=" + unit,
+		"--collect",
+		"--quiet",
+		"--property=Type=forking",
+		"--property=EnvironmentFile=" + envFile,
+		"--",
+		binary,
+	}
+	klog.Infof("Launch %s as unit %s", command, unit)
+	return exec.Command(systemdRunCmd, append(runArgs, args...)...).CombinedOutput()
+}
+
+// isUnitActive reports whether the unit mounting the path is active.
+func isUnitActive(path string) bool {
+	return exec.Command("systemctl", "is-active", "--quiet", unitName(path)).Run() == nil
+}
+
+// unitMainPID returns the PID of the FUSE process in the unit mounting the path,
+// as seen by the host.
+func unitMainPID(path string) int {
+	out, err := exec.Command("systemctl", "show", "--property=MainPID", "--value", unitName(path)).Output()
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(out)))
+	return pid
+}
+
+// removeUnitEnvFile removes the environment file of the unit mounting the path.
+func removeUnitEnvFile(path string) {
+	if err := os.Remove(unitEnvFile(path)); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Failed to remove environment file of %s: %s", path, err)
+	}
+}
+
+func writeEnvFile(path string, envs []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	var content strings.Builder
+	for _, env := range envs {
+		key, value, _ := strings.Cut(env, "=")
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+		fmt.Fprintf(&content, "%s=\"%s\"\n", key, value)
+	}
+	return os.WriteFile(path, []byte(content.String()), 0600)
+}
+
+// hostBinary copies the FUSE binary into the plugin dir shared with the host,
+// unless the copy is up-to-date, and returns the path of the copy.
+func hostBinary(command string) (string, error) {
+	source, err := exec.LookPath(command)
+	if err != nil {
+		return "", err
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(hostBinDir, filepath.Base(source))
+	if info, err := os.Stat(target); err == nil && info.Size() == sourceInfo.Size() && info.ModTime().Equal(sourceInfo.ModTime()) {
+		return target, nil
+	}
+
+	if err = os.MkdirAll(hostBinDir, 0755); err != nil {
+		return "", err
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(hostBinDir, "."+filepath.Base(source)+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(out.Name())
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err = out.Chmod(0755); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err = out.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Chtimes(out.Name(), sourceInfo.ModTime(), sourceInfo.ModTime()); err != nil {
+		return "", err
+	}
+	if err = os.Rename(out.Name(), target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
@@ -0,0 +1,19 @@
+package mounter
+
+import (
+	"testing"
+
+	"github.com/leryn1122/csi-s3/pkg/s3"
+)
+
+func TestSystemdLauncherRejectsS3fs(t *testing.T) {
+	defer func(name string) { launcher = name }(launcher)
+	launcher = LauncherSystemd
+	config := &s3.Config{Endpoint: "http://127.0.0.1:9000", AccessKeyID: "key", SecretAccessKey: "secret"}
+	for mounter, expected := range map[string]bool{S3fsMounterType: false, RcloneMounterType: true, GoofysMounterType: true} {
+		_, err := NewMounter("volume", &s3.Metadata{BucketName: "bucket", Mounter: mounter}, config, VolumeOptions{})
+		if (err == nil) != expected {
+			t.Errorf("NewMounter(%s) with launcher %s error = %v, expected success %v", mounter, launcher, err, expected)
+		}
+	}
+}
@@ -1,24 +1,29 @@
 package mounter
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"os"
 	"os/exec"
-	"strings"
-	"syscall"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/leryn1122/csi-s3/pkg/s3"
-	"github.com/mitchellh/go-ps"
 	"k8s.io/klog/v2"
 	"k8s.io/mount-utils"
 )
 
+// Mounter mounts the bucket with a FUSE process once at the staging path, and
+// bind-mounts the staging path to every target path published on the node.
 type Mounter interface {
 	Stage(stagePath string) error
-	Unstage(stagePath string) error
-	Mount(source string, target string) error
+	Unstage(ctx context.Context, stagePath string) error
+	Mount(source string, target string, readonly bool) error
+	// UpdateCredentials replaces the keys of the volume once they are rotated,
+	// and refreshes the credential files read by the FUSE process. It is also
+	// called periodically, as the keys handed to the AWS SDKs expire.
+	UpdateCredentials(config *s3.Config) error
 }
 
 const (
@@ -27,36 +32,82 @@ const (
 	GoofysMounterType = "goofys"
 )
 
-func NewMounter(metadata *s3.Metadata, config *s3.Config) (Mounter, error) {
-	mounter := metadata.Mounter
-	if len(mounter) == 0 {
-		mounter = config.Mounter
-	}
+// NewMounter creates the mounter recorded in metadata, falling back to the one
+// in config, with the options of the volume.
+func NewMounter(volumeId string, metadata *s3.Metadata, config *s3.Config, options VolumeOptions) (Mounter, error) {
+	mounter := ResolveType(metadata, config)
 	switch mounter {
 	case S3fsMounterType:
-		return newS3fsMounter(metadata, config)
+		return newS3fsMounter(volumeId, metadata, config, options)
 	case RcloneMounterType:
-		return newRcloneMounter(metadata, config)
+		return newRcloneMounter(volumeId, metadata, config, options)
 	case GoofysMounterType:
-		return newGoofysMounter(metadata, config)
+		return newGoofysMounter(volumeId, metadata, config, options)
 	default:
 		klog.Errorf("unknown mounter %s, using default mounter %s", mounter, S3fsMounterType)
-		return newS3fsMounter(metadata, config)
+		return newS3fsMounter(volumeId, metadata, config, options)
 	}
 }
 
-func fuseMount(path string, command string, args []string) error {
-	cmd := exec.Command(command, args...)
-	klog.Infof("Mount fuse with command: %s with args %s", command, args)
+// ResolveType returns the mounter recorded in metadata, falling back to the one
+// in config and then s3fs.
+func ResolveType(metadata *s3.Metadata, config *s3.Config) string {
+	switch {
+	case len(metadata.Mounter) != 0:
+		return metadata.Mounter
+	case len(config.Mounter) != 0:
+		return config.Mounter
+	}
+	return S3fsMounterType
+}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// MissingBinaries returns the mounters whose FUSE binary is not found.
+func MissingBinaries() []string {
+	var missing []string
+	for mounter, command := range map[string]string{
+		S3fsMounterType:   s3fsCmd,
+		RcloneMounterType: rcloneCmd,
+		GoofysMounterType: goofysCmd,
+	} {
+		if _, err := exec.LookPath(command); err != nil {
+			missing = append(missing, mounter)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// FuseMount describes the FUSE process mounting a path.
+type FuseMount struct {
+	Command string
+	Args    []string
+	PID     int
+}
+
+// fuseMounts holds the FuseMount of every path mounted since the driver started.
+var fuseMounts sync.Map
+
+// LookupFuseMount returns the FUSE process mounting the path, or nil if the path
+// is not mounted since the driver started.
+func LookupFuseMount(path string) *FuseMount {
+	if value, ok := fuseMounts.Load(path); ok {
+		return value.(*FuseMount)
+	}
+	return nil
+}
 
-	out, err := cmd.CombinedOutput()
+func fuseMount(path string, command string, args []string, envs []string) error {
+	klog.Infof("Mount fuse with command: %s with args %s", command, args)
+
+	out, err := launch(path, command, args, envs)
 	if err != nil {
 		return fmt.Errorf("Mount fuse mount with command: %s with args %s\nerror: %s", command, args, string(out))
 	}
-	return waitForMount(path, 10*time.Second)
+	if err = waitForMount(path, 10*time.Second); err != nil {
+		return err
+	}
+	fuseMounts.Store(path, &FuseMount{Command: command, Args: args, PID: fusePID(path)})
+	return nil
 }
 
 func waitForMount(path string, timeout time.Duration) error {
@@ -78,89 +129,13 @@ func waitForMount(path string, timeout time.Duration) error {
 	}
 }
 
-func FuseUmount(path string) error {
-	if err := mount.New("").Unmount(path); err != nil {
-		return err
-	}
-	// Wait until the process is done, while FUSE quits immediately.
-	process, err := findFuseMountProcess(path)
-	if err != nil {
-		klog.Errorf("Failed to obtain PID of fuse mount %s: %s", path, err)
-	}
-	if process == nil {
-		klog.Warningf("Unable to find PID of fuse mount %s, it must be already finished", path)
-		return nil
-	}
-	klog.Infof("Found fuse PID %v of fuse mount %s, checking if it still runs", process.Pid, path)
-	return waitForProcess(process, 0)
-}
-
-func findFuseMountProcess(path string) (*os.Process, error) {
-	processes, err := ps.Processes()
-	if err != nil {
-		return nil, err
-	}
-	for _, process := range processes {
-		cmdline, err := getCmdline(process.Pid())
-		if err != nil {
-			klog.Errorf("Unable to get cmdline of PID %v: %s", process.Pid(), err)
-			continue
-		}
-		if strings.Contains(cmdline, path) {
-			klog.Errorf("Find process %v mounting on path %s", process.Pid(), path)
-			return os.FindProcess(process.Pid())
-		}
-	}
-	return nil, nil
-}
-
-func getCmdline(pid int) (string, error) {
-	cmdlineFile := fmt.Sprintf("/proc/%v/cmdline", pid)
-	cmdline, err := os.ReadFile(cmdlineFile)
-	if err != nil {
-		return "", err
-	}
-	return string(cmdline), nil
-}
-
-func waitForProcess(process *os.Process, backoff int) error {
-	if backoff == 20 {
-		return fmt.Errorf("time waiting for PID %v to end", process.Pid)
-	}
-
-	interval := 2 * time.Second
-	for {
-		cmdline, err := getCmdline(process.Pid)
-		if err != nil {
-			klog.Warningf("Fail to check cmdline of PID %v, assuming it is dead: %s", process.Pid, err)
-			return nil
-		}
-		if cmdline == "" {
-			klog.Warning("Fuse process seems dead, killed")
-			proc, _ := os.FindProcess(process.Pid)
-			return proc.Kill()
-		}
-		if err = process.Signal(syscall.Signal(0)); err != nil {
-			klog.Warningf("Fuse process does not seem active or we are unprivileged: %s", err)
-			return nil
-		}
-		klog.Infof("Fuse process with PID %v still active, waiting...", process.Pid)
-		time.Sleep(interval + time.Duration(backoff*100))
-		return waitForProcess(process, backoff+1)
-	}
-}
-
-func CheckMount(volumeId, path string) (bool, error) {
-	isMount, err := mount.New("").IsLikelyNotMountPoint(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(path, 0750); err != nil {
-				return false, err
-			}
-		}
-		isMount = false
-	} else {
-		return false, err
+// BindMount bind-mounts the staging path to the target path. The read-only
+// bind mount is done by a bind mount following a read-only remount.
+func BindMount(source string, target string, readonly bool) error {
+	options := []string{"bind"}
+	if readonly {
+		options = append(options, "ro")
 	}
-	return isMount, nil
+	klog.Infof("Bind mount %s to %s with options %v", source, target, options)
+	return mount.New("").Mount(source, target, "", options)
 }
@@ -0,0 +1,110 @@
+package mounter
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+
+	"k8s.io/mount-utils"
+)
+
+// MountState is the state of a mount point inspected by InspectMount.
+type MountState int
+
+const (
+	// NotMounted means nothing is mounted at the path, or the path is missing.
+	NotMounted MountState = iota
+	// Mounted means the expected source is mounted at the path.
+	Mounted
+	// MountedOther means something else is mounted at the path.
+	MountedOther
+	// Corrupted means the mount at the path is broken, e.g. its FUSE process is
+	// gone.
+	Corrupted
+)
+
+func (s MountState) String() string {
+	switch s {
+	case NotMounted:
+		return "not mounted"
+	case Mounted:
+		return "mounted"
+	case MountedOther:
+		return "mounted with a different source"
+	case Corrupted:
+		return "corrupted"
+	}
+	return "unknown"
+}
+
+// InspectMount inspects the mount point at the path, which is expected to be
+// mounted from the source. The source is the staging path for the target paths
+// bind-mounted from it, or empty for the staging paths, which are expected to
+// be FUSE mounts. The mount point is returned if anything is mounted.
+func InspectMount(mounter mount.Interface, path string, source string) (MountState, *mount.MountPoint, error) {
+	notMount, err := mounter.IsLikelyNotMountPoint(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NotMounted, nil, nil
+		}
+		if mount.IsCorruptedMnt(err) {
+			return Corrupted, nil, nil
+		}
+		return NotMounted, nil, err
+	}
+	if notMount {
+		return NotMounted, nil, nil
+	}
+
+	mountPoints, err := mounter.List()
+	if err != nil {
+		return NotMounted, nil, err
+	}
+	// The last mount point of the path hides the ones mounted below it.
+	var mountPoint, sourceMountPoint *mount.MountPoint
+	for i := range mountPoints {
+		switch mountPoints[i].Path {
+		case path:
+			mountPoint = &mountPoints[i]
+		case source:
+			sourceMountPoint = &mountPoints[i]
+		}
+	}
+	if mountPoint == nil {
+		return MountedOther, nil, nil
+	}
+
+	if len(source) == 0 {
+		if strings.HasPrefix(mountPoint.Type, "fuse") {
+			return Mounted, mountPoint, nil
+		}
+		return MountedOther, mountPoint, nil
+	}
+	// A bind mount shows the device of its source. The FUSE mounts of several
+	// volumes may share the device name, e.g. `s3fs`, so the device numbers are
+	// compared as well.
+	if sourceMountPoint == nil || sourceMountPoint.Device != mountPoint.Device || !sameDevice(path, source) {
+		return MountedOther, mountPoint, nil
+	}
+	return Mounted, mountPoint, nil
+}
+
+// IsReadOnly reports whether the mount point is mounted read-only.
+func IsReadOnly(mountPoint *mount.MountPoint) bool {
+	return slices.Contains(mountPoint.Opts, "ro")
+}
+
+func sameDevice(path string, source string) bool {
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false
+	}
+	pathStat, ok := pathInfo.Sys().(*syscall.Stat_t)
+	sourceStat, ok2 := sourceInfo.Sys().(*syscall.Stat_t)
+	return ok && ok2 && pathStat.Dev == sourceStat.Dev
+}
@@ -0,0 +1,129 @@
+package mounter
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"k8s.io/mount-utils"
+)
+
+func TestInspectMount(t *testing.T) {
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	otherStaging := filepath.Join(dir, "other-staging")
+	target := filepath.Join(dir, "target")
+	for _, path := range []string{staging, otherStaging, target} {
+		if err := os.Mkdir(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stagingMount := mount.MountPoint{Device: "csis3:bucket/volume", Path: staging, Type: "fuse.rclone"}
+	otherStagingMount := mount.MountPoint{Device: "csis3:bucket/other", Path: otherStaging, Type: "fuse.rclone"}
+
+	cases := []struct {
+		name        string
+		mountPoints []mount.MountPoint
+		checkError  error
+		path        string
+		source      string
+		expected    MountState
+	}{
+		{
+			name:     "missing path",
+			path:     filepath.Join(dir, "missing"),
+			source:   staging,
+			expected: NotMounted,
+		},
+		{
+			name:        "not mounted target",
+			mountPoints: []mount.MountPoint{stagingMount},
+			path:        target,
+			source:      staging,
+			expected:    NotMounted,
+		},
+		{
+			name:        "fuse staging",
+			mountPoints: []mount.MountPoint{stagingMount},
+			path:        staging,
+			expected:    Mounted,
+		},
+		{
+			name:        "non-fuse staging",
+			mountPoints: []mount.MountPoint{{Device: "/dev/sda1", Path: staging, Type: "ext4"}},
+			path:        staging,
+			expected:    MountedOther,
+		},
+		{
+			name:        "target bound from staging",
+			mountPoints: []mount.MountPoint{stagingMount, {Device: stagingMount.Device, Path: target, Opts: []string{"bind"}}},
+			path:        target,
+			source:      staging,
+			expected:    Mounted,
+		},
+		{
+			name:        "target bound from another staging",
+			mountPoints: []mount.MountPoint{stagingMount, otherStagingMount, {Device: otherStagingMount.Device, Path: target, Opts: []string{"bind"}}},
+			path:        target,
+			source:      staging,
+			expected:    MountedOther,
+		},
+		{
+			name:        "target mounted over the bind mount",
+			mountPoints: []mount.MountPoint{stagingMount, {Device: stagingMount.Device, Path: target}, {Device: "tmpfs", Path: target, Type: "tmpfs"}},
+			path:        target,
+			source:      staging,
+			expected:    MountedOther,
+		},
+		{
+			name:        "corrupted target",
+			mountPoints: []mount.MountPoint{stagingMount, {Device: stagingMount.Device, Path: target}},
+			checkError:  &os.PathError{Op: "stat", Path: target, Err: syscall.ENOTCONN},
+			path:        target,
+			source:      staging,
+			expected:    Corrupted,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mounter := mount.NewFakeMounter(c.mountPoints)
+			if c.checkError != nil {
+				mounter.MountCheckErrors = map[string]error{c.path: c.checkError}
+			}
+			state, _, err := InspectMount(mounter, c.path, c.source)
+			if err != nil {
+				t.Fatalf("InspectMount(%q, %q) failed: %v", c.path, c.source, err)
+			}
+			if state != c.expected {
+				t.Errorf("InspectMount(%q, %q) = %s, expected %s", c.path, c.source, state, c.expected)
+			}
+		})
+	}
+}
+
+func TestInspectMountAfterBindMount(t *testing.T) {
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	target := filepath.Join(dir, "target")
+	for _, path := range []string{staging, target} {
+		if err := os.Mkdir(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "s3fs", Path: staging, Type: "fuse.s3fs"}})
+	if err := mounter.Mount(staging, target, "", []string{"bind", "ro"}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, mountPoint, err := InspectMount(mounter, target, staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != Mounted {
+		t.Errorf("InspectMount(%q, %q) = %s, expected %s", target, staging, state, Mounted)
+	}
+	if !IsReadOnly(mountPoint) {
+		t.Errorf("IsReadOnly(%v) = false, expected true", mountPoint)
+	}
+}
@@ -0,0 +1,151 @@
+package mounter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// optionsParameterSuffix follows the mounter name in the volume parameters
+// which pass mounter options, e.g. `s3fs.options/max_stat_cache_size: "1000"`.
+const optionsParameterSuffix = ".options/"
+
+// VolumeOptions are the options of a volume given by the CO.
+type VolumeOptions struct {
+	// Parameters are the volume context, which carries the mounter options.
+	Parameters map[string]string
+	// MountFlags are the mount options of the StorageClass, either `name` or
+	// `name=value`, which may be separated by commas.
+	MountFlags []string
+	// ReadOnly stages the bucket with a read-only FUSE mount.
+	ReadOnly bool
+}
+
+// mountOption is a mounter option, which is a flag without any value.
+type mountOption struct {
+	name  string
+	value string
+}
+
+func (option mountOption) String() string {
+	if len(option.value) == 0 {
+		return option.name
+	}
+	return option.name + "=" + option.value
+}
+
+// mountOptions are the options of a mounter in the order they are first set.
+type mountOptions []mountOption
+
+// set sets the option, replacing the value of the one already set.
+func (options mountOptions) set(name string, value string) mountOptions {
+	for i := range options {
+		if options[i].name == name {
+			options[i].value = value
+			return options
+		}
+	}
+	return append(options, mountOption{name: name, value: value})
+}
+
+func (options mountOptions) unset(name string) mountOptions {
+	for i := range options {
+		if options[i].name == name {
+			return append(options[:i], options[i+1:]...)
+		}
+	}
+	return options
+}
+
+func (options mountOptions) get(name string) (string, bool) {
+	for _, option := range options {
+		if option.name == name {
+			return option.value, true
+		}
+	}
+	return "", false
+}
+
+// buildMountOptions merges the options of the mounter in order of precedence:
+// the defaults, the mount flags of the StorageClass, and the volume parameters
+// prefixed by `<mounter>.options/`. Only the options of the allow-list, which
+// tells whether they take a value, are accepted, so that the driver controls
+// the endpoint, the credentials and the files of the FUSE process.
+func buildMountOptions(mounterType string, allowed map[string]bool, defaults mountOptions, volumeOptions VolumeOptions) (mountOptions, error) {
+	options := append(mountOptions(nil), defaults...)
+	for _, flags := range volumeOptions.MountFlags {
+		for _, flag := range strings.Split(flags, ",") {
+			// The rclone and goofys flags are accepted with their dashes.
+			flag = strings.TrimLeft(strings.TrimSpace(flag), "-")
+			if len(flag) == 0 {
+				continue
+			}
+			name, value, _ := strings.Cut(flag, "=")
+			if err := validateMountOption(mounterType, allowed, name, value); err != nil {
+				return nil, err
+			}
+			options = options.set(name, value)
+		}
+	}
+
+	prefix := mounterType + optionsParameterSuffix
+	var keys []string
+	for key := range volumeOptions.Parameters {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, value := strings.TrimPrefix(key, prefix), volumeOptions.Parameters[key]
+		// The flag is given as `true` or `false`, which drops a default one.
+		if takesValue, ok := allowed[name]; ok && !takesValue {
+			switch value {
+			case "", "true":
+				value = ""
+			case "false":
+				options = options.unset(name)
+				continue
+			default:
+				return nil, fmt.Errorf("%s option %s must be true or false: %s", mounterType, name, value)
+			}
+		}
+		if err := validateMountOption(mounterType, allowed, name, value); err != nil {
+			return nil, err
+		}
+		options = options.set(name, value)
+	}
+	return options, nil
+}
+
+func validateMountOption(mounterType string, allowed map[string]bool, name string, value string) error {
+	takesValue, ok := allowed[name]
+	switch {
+	case !ok:
+		return fmt.Errorf("%s option %s is not allowed", mounterType, name)
+	case takesValue && len(value) == 0:
+		return fmt.Errorf("%s option %s requires a value", mounterType, name)
+	case !takesValue && len(value) != 0:
+		return fmt.Errorf("%s option %s takes no value", mounterType, name)
+	}
+	// The value must neither start another option nor break the argument.
+	if strings.HasPrefix(value, "-") || strings.ContainsAny(value, ", \t\n\x00") {
+		return fmt.Errorf("invalid value of %s option %s: %q", mounterType, name, value)
+	}
+	return nil
+}
+
+// ValidateOptions validates the options of the mounter, so that a volume with
+// invalid options fails to be created rather than to be staged.
+func ValidateOptions(mounterType string, options VolumeOptions) error {
+	var err error
+	switch mounterType {
+	case RcloneMounterType:
+		_, err = rcloneOptions(options)
+	case GoofysMounterType:
+		_, err = goofysOptions(options)
+	default:
+		_, err = s3fsOptions(options, true)
+	}
+	return err
+}
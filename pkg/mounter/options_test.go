@@ -0,0 +1,191 @@
+package mounter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/leryn1122/csi-s3/pkg/s3"
+)
+
+func TestMounterArgs(t *testing.T) {
+	const stagePath = "/staging"
+	const pwFile = "/credentials/passwd-s3fs"
+
+	cases := []struct {
+		name     string
+		mounter  string
+		style    string
+		tls      s3.TLSConfig
+		options  VolumeOptions
+		expected []string
+	}{
+		{
+			name:    "s3fs defaults",
+			mounter: S3fsMounterType,
+			expected: []string{"bucket:/prefix", stagePath,
+				"-o", "passwd_file=" + pwFile, "-o", "url=https://s3.example.com", "-o", "endpoint=region",
+				"-o", "use_path_request_style", "-o", "allow_other", "-o", "mp_umask=000"},
+		},
+		{
+			name:    "s3fs read-only",
+			mounter: S3fsMounterType,
+			options: VolumeOptions{ReadOnly: true},
+			expected: []string{"bucket:/prefix", stagePath,
+				"-o", "passwd_file=" + pwFile, "-o", "url=https://s3.example.com", "-o", "endpoint=region",
+				"-o", "use_path_request_style", "-o", "allow_other", "-o", "mp_umask=222", "-o", "ro"},
+		},
+		{
+			name:    "s3fs mount flags and parameters",
+			mounter: S3fsMounterType,
+			options: VolumeOptions{
+				MountFlags: []string{"uid=1000,gid=1000", "mp_umask=022", "max_stat_cache_size=100"},
+				Parameters: map[string]string{
+					"s3fs.options/max_stat_cache_size": "1000",
+					"s3fs.options/allow_other":         "false",
+					"s3fs.options/enable_noobj_cache":  "true",
+					"rclone.options/vfs-cache-mode":    "full",
+				},
+			},
+			expected: []string{"bucket:/prefix", stagePath,
+				"-o", "passwd_file=" + pwFile, "-o", "url=https://s3.example.com", "-o", "endpoint=region",
+				"-o", "use_path_request_style", "-o", "mp_umask=022", "-o", "uid=1000", "-o", "gid=1000",
+				"-o", "max_stat_cache_size=1000", "-o", "enable_noobj_cache"},
+		},
+		{
+			name:    "s3fs virtual-hosted style",
+			mounter: S3fsMounterType,
+			style:   s3.AddressingStyleVirtual,
+			expected: []string{"bucket:/prefix", stagePath,
+				"-o", "passwd_file=" + pwFile, "-o", "url=https://s3.example.com", "-o", "endpoint=region",
+				"-o", "allow_other", "-o", "mp_umask=000"},
+		},
+		{
+			name:    "s3fs TLS",
+			mounter: S3fsMounterType,
+			tls:     s3.TLSConfig{InsecureSkipVerify: true, ClientCert: "cert", ClientKey: "key"},
+			expected: []string{"bucket:/prefix", stagePath,
+				"-o", "passwd_file=" + pwFile, "-o", "url=https://s3.example.com", "-o", "endpoint=region",
+				"-o", "no_check_certificate", "-o", "ssl_verify_hostname=0",
+				"-o", "ssl_client_cert=/credentials/client.crt:PEM:/credentials/client.key:PEM",
+				"-o", "use_path_request_style", "-o", "allow_other", "-o", "mp_umask=000"},
+		},
+		{
+			name:     "rclone defaults",
+			mounter:  RcloneMounterType,
+			expected: []string{"mount", "csis3:bucket/prefix", stagePath, "--daemon", "--allow-other"},
+		},
+		{
+			name:    "rclone parameters, mount flags and read-only",
+			mounter: RcloneMounterType,
+			options: VolumeOptions{
+				MountFlags: []string{"--vfs-cache-mode=writes", "dir-cache-time=1m"},
+				Parameters: map[string]string{
+					"vfsCacheMode":                     "full",
+					"bufferSize":                       "32M",
+					"rclone.options/vfs-cache-mode":    "minimal",
+					"rclone.options/vfs-read-ahead":    "64M",
+					"rclone.options/no-modtime":        "true",
+					"rclone.options/vfs-cache-max-age": "1h",
+				},
+				ReadOnly: true,
+			},
+			expected: []string{"mount", "csis3:bucket/prefix", stagePath, "--daemon", "--allow-other",
+				"--buffer-size=32M", "--vfs-cache-mode=minimal", "--dir-cache-time=1m",
+				"--no-modtime", "--vfs-cache-max-age=1h", "--vfs-read-ahead=64M", "--read-only"},
+		},
+		{
+			name:    "rclone TLS",
+			mounter: RcloneMounterType,
+			tls:     s3.TLSConfig{CABundle: "ca", InsecureSkipVerify: true, ClientCert: "cert", ClientKey: "key"},
+			expected: []string{"mount", "csis3:bucket/prefix", stagePath, "--daemon", "--allow-other",
+				"--ca-cert=/credentials/ca.crt", "--client-cert=/credentials/client.crt", "--client-key=/credentials/client.key",
+				"--no-check-certificate"},
+		},
+		{
+			name:    "goofys parameters and mount flags",
+			mounter: GoofysMounterType,
+			options: VolumeOptions{
+				MountFlags: []string{"cheap", "uid=1000"},
+				Parameters: map[string]string{
+					"statCacheTTL":                 "1m",
+					"uid":                          "0",
+					"goofys.options/file-mode":     "0644",
+					"goofys.options/storage-class": "STANDARD_IA",
+				},
+			},
+			expected: []string{"--endpoint", "https://s3.example.com", "-o", "allow_other", "--region", "region",
+				"--stat-cache-ttl", "1m", "--uid", "1000", "--cheap", "--file-mode", "0644", "--storage-class", "STANDARD_IA",
+				"bucket:prefix", stagePath},
+		},
+		{
+			name:    "goofys virtual-hosted style",
+			mounter: GoofysMounterType,
+			style:   s3.AddressingStyleVirtual,
+			expected: []string{"--endpoint", "https://s3.example.com", "-o", "allow_other", "--region", "region", "--subdomain",
+				"bucket:prefix", stagePath},
+		},
+		{
+			name:    "goofys read-only",
+			mounter: GoofysMounterType,
+			options: VolumeOptions{ReadOnly: true},
+			expected: []string{"--endpoint", "https://s3.example.com", "-o", "allow_other", "-o", "ro", "--region", "region",
+				"bucket:prefix", stagePath},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := &s3.Config{Endpoint: "https://s3.example.com", Region: "region", AddressingStyle: c.style, TLS: c.tls}
+			mounter, err := NewMounter("volume", &s3.Metadata{BucketName: "bucket", FsPathPrefix: "prefix", Mounter: c.mounter}, config, c.options)
+			if err != nil {
+				t.Fatalf("NewMounter failed: %v", err)
+			}
+			var files tlsFiles
+			if len(c.tls.CABundle) != 0 {
+				files.caBundle = "/credentials/" + caBundleFile
+			}
+			if len(c.tls.ClientCert) != 0 {
+				files.clientCert, files.clientKey = "/credentials/"+clientCertFile, "/credentials/"+clientKeyFile
+			}
+			var args []string
+			switch mounter := mounter.(type) {
+			case *s3fsMounter:
+				args = mounter.args(stagePath, pwFile, files)
+			case *rcloneMounter:
+				args = mounter.args(stagePath, files)
+			case *goofysMounter:
+				args = mounter.args(stagePath)
+			}
+			if !reflect.DeepEqual(args, c.expected) {
+				t.Errorf("args = %q\nexpected %q", args, c.expected)
+			}
+		})
+	}
+}
+
+func TestInvalidMountOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		mounter string
+		options VolumeOptions
+	}{
+		{"s3fs option naming a file", S3fsMounterType, VolumeOptions{MountFlags: []string{"passwd_file=/etc/shadow"}}},
+		{"s3fs option injecting another one", S3fsMounterType, VolumeOptions{Parameters: map[string]string{"s3fs.options/uid": "0,passwd_file=/etc/shadow"}}},
+		{"s3fs option without its value", S3fsMounterType, VolumeOptions{MountFlags: []string{"uid"}}},
+		{"s3fs flag with a value", S3fsMounterType, VolumeOptions{MountFlags: []string{"allow_other=1"}}},
+		{"s3fs flag parameter", S3fsMounterType, VolumeOptions{Parameters: map[string]string{"s3fs.options/allow_other": "yes"}}},
+		{"rclone option naming a file", RcloneMounterType, VolumeOptions{MountFlags: []string{"--config=/etc/rclone.conf"}}},
+		{"rclone unknown cache mode", RcloneMounterType, VolumeOptions{MountFlags: []string{"vfs-cache-mode=all"}}},
+		{"goofys option naming a host", GoofysMounterType, VolumeOptions{Parameters: map[string]string{"goofys.options/endpoint": "evil.example.com"}}},
+		{"goofys option value as a flag", GoofysMounterType, VolumeOptions{MountFlags: []string{"acl=--endpoint"}}},
+		{"goofys invalid duration", GoofysMounterType, VolumeOptions{MountFlags: []string{"stat-cache-ttl=1parsec"}}},
+		{"goofys parameter injecting an argument", GoofysMounterType, VolumeOptions{Parameters: map[string]string{"uid": "0 --endpoint"}}},
+		{"goofys invalid mode", GoofysMounterType, VolumeOptions{Parameters: map[string]string{"dirMode": "0999"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ValidateOptions(c.mounter, c.options); err == nil {
+				t.Errorf("ValidateOptions(%s, %+v) succeeded, expected an error", c.mounter, c.options)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+)
+
+const (
+	fuseDevice         = "/dev/fuse"
+	fuseConnectionsDir = "/sys/fs/fuse/connections"
+)
+
+// AdoptFuseMount registers the FUSE process mounting the path, as recorded by
+// the previous driver. The PID is resolved again unless it still serves the
+// mount, since it may have been reused.
+func AdoptFuseMount(path string, args []string, pid int) {
+	if launcher == LauncherSystemd || !isFuseProcessOf(pid, path) {
+		pid = fusePID(path)
+	}
+	fuseMounts.Store(path, &FuseMount{Args: args, PID: pid})
+}
+
+// IsFuseProcessAlive reports whether the FUSE process mounting the path still
+// runs.
+func IsFuseProcessAlive(path string) (bool, error) {
+	// The processes of the host are invisible from the plugin container.
+	if launcher == LauncherSystemd {
+		return isUnitActive(path), nil
+	}
+	if fuse := LookupFuseMount(path); fuse != nil && isFuseProcessOf(fuse.PID, path) {
+		return true, nil
+	}
+	pid, err := findFuseProcess(path)
+	return pid != 0, err
+}
+
+// fuseMountPID returns the PID of the FUSE process mounting the path, preferring
+// the one recorded at mount time, or 0 if it is unknown.
+func fuseMountPID(path string) int {
+	if fuse := LookupFuseMount(path); fuse != nil && fuse.PID != 0 {
+		if launcher == LauncherSystemd || isFuseProcessOf(fuse.PID, path) {
+			return fuse.PID
+		}
+	}
+	return fusePID(path)
+}
+
+// fusePID resolves the PID of the FUSE process mounting the path, or returns 0
+// if it is not found.
+func fusePID(path string) int {
+	if launcher == LauncherSystemd {
+		return unitMainPID(path)
+	}
+	pid, err := findFuseProcess(path)
+	if err != nil {
+		klog.Warningf("Unable to find FUSE process mounting %s: %s", path, err)
+	}
+	return pid
+}
+
+// fuseConnection returns the ID of the FUSE connection serving the mount at the
+// path, or 0 if the path is not a FUSE mount. The ID is the device number of
+// the mount in /proc/self/mountinfo, which names the connection in
+// /sys/fs/fuse/connections.
+func fuseConnection(path string) (int, error) {
+	infos, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return 0, err
+	}
+	path = filepath.Clean(path)
+	connection := 0
+	// The last mount point of the path hides the ones mounted below it.
+	for _, info := range infos {
+		if info.MountPoint != path {
+			continue
+		}
+		connection = 0
+		if strings.HasPrefix(info.FsType, "fuse") && info.Major == 0 {
+			connection = info.Minor
+		}
+	}
+	return connection, nil
+}
+
+// findFuseProcess returns the PID of the FUSE process serving the mount at the
+// path, or 0 if it is not found. The process is the one holding /dev/fuse open
+// on the FUSE connection of the mount, see servesFuseMount.
+func findFuseProcess(path string) (int, error) {
+	connection, err := fuseConnection(path)
+	if err != nil || connection == 0 {
+		return 0, err
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	var found []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if servesFuseMount(pid, path, connection) {
+			found = append(found, pid)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return 0, nil
+	case 1:
+		klog.V(4).Infof("Found FUSE process %d of connection %d mounting %s", found[0], connection, path)
+		return found[0], nil
+	}
+	return 0, fmt.Errorf("several FUSE processes %v mount %s", found, path)
+}
+
+// isFuseProcessOf reports whether the process is the FUSE process serving the
+// mount at the path.
+func isFuseProcessOf(pid int, path string) bool {
+	connection, err := fuseConnection(path)
+	if err != nil {
+		connection = 0
+	}
+	return servesFuseMount(pid, path, connection)
+}
+
+// servesFuseMount reports whether the process serves the FUSE connection of the
+// mount at the path. The connection of each /dev/fuse descriptor is told by its
+// fdinfo on recent kernels. On the older ones, or if the connection is unknown,
+// e.g. once unmounted, the process is rather matched by holding /dev/fuse open
+// and taking the path as one of its arguments.
+func servesFuseMount(pid int, path string, connection int) bool {
+	if pid <= 0 {
+		return false
+	}
+	connections, held := fuseDeviceConnections(pid)
+	if !held {
+		return false
+	}
+	if connection != 0 && len(connections) != 0 {
+		for _, c := range connections {
+			if c == connection {
+				return true
+			}
+		}
+		return false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		if len(arg) != 0 && filepath.Clean(arg) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// fuseDeviceConnections returns the FUSE connections of the /dev/fuse
+// descriptors of the process, as told by the `fuse_connection` field of their
+// fdinfo, and whether the process holds /dev/fuse open at all.
+func fuseDeviceConnections(pid int) ([]int, bool) {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return nil, false
+	}
+	var connections []int
+	held := false
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err != nil || target != fuseDevice {
+			continue
+		}
+		held = true
+		fdinfo, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%s", pid, fd.Name()))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(fdinfo), "\n") {
+			if value, found := strings.CutPrefix(line, "fuse_connection:"); found {
+				if connection, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+					connections = append(connections, connection)
+				}
+			}
+		}
+	}
+	return connections, held
+}
+
+// abortFuseConnection aborts the FUSE connection, which fails every pending
+// request and makes the FUSE process exit. It requires fusectl mounted at
+// /sys/fs/fuse/connections.
+func abortFuseConnection(connection int) error {
+	return os.WriteFile(filepath.Join(fuseConnectionsDir, strconv.Itoa(connection), "abort"), []byte("1"), 0200)
+}
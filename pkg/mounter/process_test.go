@@ -0,0 +1,41 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFindFuseProcessByConnection(t *testing.T) {
+	// The test serves the FUSE mount itself, without taking its path as an
+	// argument, so that it is only found by the connection.
+	device, err := os.OpenFile(fuseDevice, os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("FUSE is unavailable: %v", err)
+	}
+	defer device.Close()
+	if connections, _ := fuseDeviceConnections(os.Getpid()); len(connections) != 0 {
+		t.Fatalf("connections %v told before mounting", connections)
+	}
+	path := t.TempDir()
+	options := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", device.Fd())
+	if err = syscall.Mount("csi-s3-test", path, "fuse.csi-s3-test", syscall.MS_NOSUID|syscall.MS_NODEV, options); err != nil {
+		t.Skipf("unable to mount FUSE: %v", err)
+	}
+	defer syscall.Unmount(path, syscall.MNT_DETACH)
+
+	if connections, _ := fuseDeviceConnections(os.Getpid()); len(connections) == 0 {
+		t.Skip("the kernel does not tell the connections of /dev/fuse")
+	}
+	connection, err := fuseConnection(path)
+	if err != nil || connection == 0 {
+		t.Fatalf("fuseConnection(%s) = %d, %v", path, connection, err)
+	}
+	if pid, err := findFuseProcess(path); pid != os.Getpid() || err != nil {
+		t.Errorf("findFuseProcess(%s) = %d, %v, expected %d", path, pid, err, os.Getpid())
+	}
+	if servesFuseMount(os.Getpid(), path, connection+1) {
+		t.Errorf("the process serves connection %d, not %d", connection, connection+1)
+	}
+}
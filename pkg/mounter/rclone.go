@@ -1,30 +1,225 @@
 package mounter
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/leryn1122/csi-s3/pkg/s3"
 )
 
-const rcloneCmd = "rclone"
+const (
+	rcloneCmd = "rclone"
+	// rcloneRemote is the name of the S3 remote which is built from the environment.
+	rcloneRemote = "csis3"
+)
+
+// rcloneVfsOptions maps the volume parameters to the rclone VFS flags.
+var rcloneVfsOptions = map[string]string{
+	"vfsCacheMode":          "vfs-cache-mode",
+	"vfsCacheMaxAge":        "vfs-cache-max-age",
+	"vfsCacheMaxSize":       "vfs-cache-max-size",
+	"vfsCachePollInterval":  "vfs-cache-poll-interval",
+	"vfsReadAhead":          "vfs-read-ahead",
+	"vfsReadChunkSize":      "vfs-read-chunk-size",
+	"vfsReadChunkSizeLimit": "vfs-read-chunk-size-limit",
+	"vfsWriteBack":          "vfs-write-back",
+	"dirCacheTime":          "dir-cache-time",
+	"bufferSize":            "buffer-size",
+}
+
+// rcloneAllowedOptions are the rclone flags given by users, and whether they
+// take a value. The ones naming files, e.g. `--cache-dir`, are left out.
+var rcloneAllowedOptions = map[string]bool{
+	"allow-other":               false,
+	"vfs-cache-mode":            true,
+	"vfs-cache-max-age":         true,
+	"vfs-cache-max-size":        true,
+	"vfs-cache-poll-interval":   true,
+	"vfs-read-ahead":            true,
+	"vfs-read-chunk-size":       true,
+	"vfs-read-chunk-size-limit": true,
+	"vfs-write-back":            true,
+	"vfs-fast-fingerprint":      false,
+	"dir-cache-time":            true,
+	"poll-interval":             true,
+	"attr-timeout":              true,
+	"buffer-size":               true,
+	"uid":                       true,
+	"gid":                       true,
+	"umask":                     true,
+	"dir-perms":                 true,
+	"file-perms":                true,
+	"no-modtime":                false,
+	"no-checksum":               false,
+	"transfers":                 true,
+	"checkers":                  true,
+	"s3-chunk-size":             true,
+	"s3-upload-concurrency":     true,
+	"s3-storage-class":          true,
+	"s3-acl":                    true,
+}
+
+var rcloneVfsCacheModes = map[string]bool{
+	"off":     true,
+	"minimal": true,
+	"writes":  true,
+	"full":    true,
+}
+
+// rcloneMultiNodeWriterSupport rejects the writers on several nodes when the
+// VFS cache holds the writes, since they are uploaded in the background once
+// the write-back delay passes, overwriting the changes of the other nodes.
+func rcloneMultiNodeWriterSupport(volumeOptions VolumeOptions) AccessModeSupport {
+	options, err := rcloneOptions(volumeOptions)
+	if err != nil {
+		return AccessModeUnsupported
+	}
+	switch mode, _ := options.get("vfs-cache-mode"); mode {
+	case "writes", "full":
+		return AccessModeUnsupported
+	}
+	return AccessModeUnsafe
+}
 
 type rcloneMounter struct {
-	metadata      *s3.Metadata
-	url           string
-	region        string
-	pwFileContent string
+	volumeId    string
+	metadata    *s3.Metadata
+	url         string
+	region      string
+	keys        rotatingKeys
+	pathStyle   bool
+	options     mountOptions
+	tls         s3.TLSConfig
+	credentials s3.CredentialsConfig
+	// stsEndpoint is empty once the AWS SDK picks AWS STS.
+	stsEndpoint string
+}
+
+func newRcloneMounter(volumeId string, metadata *s3.Metadata, config *s3.Config, volumeOptions VolumeOptions) (Mounter, error) {
+	if err := ValidateCredentials(RcloneMounterType, config); err != nil {
+		return nil, err
+	}
+	options, err := rcloneOptions(volumeOptions)
+	if err != nil {
+		return nil, err
+	}
+	var stsEndpoint string
+	if !config.UsesAWSSTS() {
+		stsEndpoint = config.STSEndpoint()
+	}
+	return &rcloneMounter{
+		volumeId:    volumeId,
+		metadata:    metadata,
+		url:         config.Endpoint,
+		region:      config.Region,
+		keys:        rotatingKeys{keys: keysOf(config)},
+		pathStyle:   config.UsePathStyle(),
+		options:     options,
+		tls:         config.TLS,
+		credentials: config.Credentials,
+		stsEndpoint: stsEndpoint,
+	}, nil
+}
+
+func rcloneOptions(volumeOptions VolumeOptions) (mountOptions, error) {
+	defaults := mountOptions{{name: "allow-other"}}
+	var keys []string
+	for key := range volumeOptions.Parameters {
+		if _, ok := rcloneVfsOptions[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, value := rcloneVfsOptions[key], volumeOptions.Parameters[key]
+		if err := validateMountOption(RcloneMounterType, rcloneAllowedOptions, name, value); err != nil {
+			return nil, err
+		}
+		defaults = defaults.set(name, value)
+	}
+	options, err := buildMountOptions(RcloneMounterType, rcloneAllowedOptions, defaults, volumeOptions)
+	if err != nil {
+		return nil, err
+	}
+	if mode, ok := options.get("vfs-cache-mode"); ok && !rcloneVfsCacheModes[mode] {
+		return nil, fmt.Errorf("unknown rclone VFS cache mode: %s", mode)
+	}
+	if volumeOptions.ReadOnly {
+		options = options.set("read-only", "")
+	}
+	return options, nil
+}
+
+func (rclone *rcloneMounter) Stage(stagePath string) error {
+	files, err := writeTLSFiles(rclone.volumeId, rclone.tls)
+	if err != nil {
+		return err
+	}
+	envs, err := rclone.envs()
+	if err != nil {
+		return err
+	}
+	return fuseMount(stagePath, rcloneCmd, rclone.args(stagePath, files), envs)
+}
+
+func (rclone *rcloneMounter) args(stagePath string, files tlsFiles) []string {
+	args := []string{
+		"mount",
+		fmt.Sprintf("%s:%s/%s", rcloneRemote, rclone.metadata.BucketName, rclone.metadata.FsPathPrefix),
+		stagePath,
+		"--daemon",
+	}
+	for _, option := range rclone.options {
+		args = append(args, "--"+option.String())
+	}
+	if len(files.caBundle) != 0 {
+		args = append(args, "--ca-cert="+files.caBundle)
+	}
+	if len(files.clientCert) != 0 {
+		args = append(args, "--client-cert="+files.clientCert, "--client-key="+files.clientKey)
+	}
+	if rclone.tls.InsecureSkipVerify {
+		args = append(args, "--no-check-certificate")
+	}
+	return args
 }
 
-func newRcloneMounter(metadata *s3.Metadata, config *s3.Config) (Mounter, error) {
-	return nil, nil
+func (rclone *rcloneMounter) Unstage(ctx context.Context, stagePath string) error {
+	return FuseUmount(ctx, stagePath)
 }
 
-func (rclone *rcloneMounter) Stage(stageTarget string) error {
-	panic("unimplemented")
+func (rclone *rcloneMounter) Mount(source string, target string, readonly bool) error {
+	return BindMount(source, target, readonly)
 }
 
-func (rclone *rcloneMounter) Unstage(stageTarget string) error {
-	panic("unimplemented")
+func (rclone *rcloneMounter) UpdateCredentials(config *s3.Config) error {
+	rclone.keys.set(keysOf(config))
+	_, err := awsProviderEnvs(rclone.volumeId, rclone.keys.get(), rclone.credentials)
+	return err
 }
 
-func (rclone *rcloneMounter) Mount(source string, target string) error {
-	panic("unimplemented")
+// envs builds the rclone S3 remote from environment, so that the credentials
+// never appear on the command line. The credentials are taken by the AWS SDK
+// of rclone.
+func (rclone *rcloneMounter) envs() ([]string, error) {
+	remote := "RCLONE_CONFIG_" + strings.ToUpper(rcloneRemote)
+	envs := []string{
+		remote + "_TYPE=s3",
+		remote + "_PROVIDER=Other",
+		remote + "_FORCE_PATH_STYLE=" + strconv.FormatBool(rclone.pathStyle),
+		remote + "_ENDPOINT=" + rclone.url,
+		remote + "_REGION=" + rclone.region,
+		remote + "_ENV_AUTH=true",
+	}
+	if len(rclone.stsEndpoint) != 0 {
+		envs = append(envs, remote+"_STS_ENDPOINT="+rclone.stsEndpoint)
+	}
+	providerEnvs, err := awsProviderEnvs(rclone.volumeId, rclone.keys.get(), rclone.credentials)
+	if err != nil {
+		return nil, err
+	}
+	return append(envs, providerEnvs...), nil
 }
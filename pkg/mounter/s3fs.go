@@ -1,66 +1,184 @@
 package mounter
 
 import (
+	"context"
 	"fmt"
+
 	"github.com/leryn1122/csi-s3/pkg/s3"
-	"os"
 )
 
-const s3fsCmd = "s3fs"
+const (
+	s3fsCmd          = "s3fs"
+	s3fsPasswordFile = "passwd-s3fs"
+)
+
+// s3fsAllowedOptions are the s3fs options given by users, and whether they take
+// a value. The ones naming files or hosts are left out.
+var s3fsAllowedOptions = map[string]bool{
+	"allow_other":                false,
+	"uid":                        true,
+	"gid":                        true,
+	"umask":                      true,
+	"mp_umask":                   true,
+	"use_path_request_style":     false,
+	"default_acl":                true,
+	"storage_class":              true,
+	"max_stat_cache_size":        true,
+	"stat_cache_expire":          true,
+	"stat_cache_interval_expire": true,
+	"enable_noobj_cache":         false,
+	"multipart_size":             true,
+	"parallel_count":             true,
+	"multireq_max":               true,
+	"max_dirty_data":             true,
+	"readwrite_timeout":          true,
+	"connect_timeout":            true,
+	"retries":                    true,
+	"list_object_max_keys":       true,
+	"nomultipart":                false,
+	"nocopyapi":                  false,
+	"norenameapi":                false,
+	"complement_stat":            false,
+	"compat_dir":                 false,
+	"enable_content_md5":         false,
+	"sigv2":                      false,
+	"sigv4":                      false,
+	"kernel_cache":               false,
+}
 
 type s3fsMounter struct {
-	metadata      *s3.Metadata
-	url           string
-	region        string
-	pwFileContent string
+	volumeId string
+	metadata *s3.Metadata
+	url      string
+	region   string
+	keys     rotatingKeys
+	options  mountOptions
+	tls      s3.TLSConfig
+	// iamRole fetches the credentials of the instance role.
+	iamRole bool
 }
 
-func newS3fsMounter(metadata *s3.Metadata, config *s3.Config) (Mounter, error) {
+func newS3fsMounter(volumeId string, metadata *s3.Metadata, config *s3.Config, volumeOptions VolumeOptions) (Mounter, error) {
+	if err := validateLauncher(S3fsMounterType); err != nil {
+		return nil, err
+	}
+	if err := ValidateCredentials(S3fsMounterType, config); err != nil {
+		return nil, err
+	}
+	options, err := s3fsOptions(volumeOptions, config.UsePathStyle())
+	if err != nil {
+		return nil, err
+	}
 	return &s3fsMounter{
-		metadata:      metadata,
-		url:           config.Endpoint,
-		region:        config.Region,
-		pwFileContent: config.AccessKeyID + ":" + config.SecretAccessKey,
+		volumeId: volumeId,
+		metadata: metadata,
+		url:      config.Endpoint,
+		region:   config.Region,
+		keys:     rotatingKeys{keys: keysOf(config)},
+		options:  options,
+		tls:      config.TLS,
+		iamRole:  !config.Credentials.UsesKeys(),
 	}, nil
 }
 
-func (s3fs *s3fsMounter) Stage(_ string) error {
-	return nil
+// s3fsOptions builds the s3fs options. s3fs addresses the bucket in
+// virtual-hosted style unless `use_path_request_style` is given.
+func s3fsOptions(volumeOptions VolumeOptions, pathStyle bool) (mountOptions, error) {
+	mpUmask := "000"
+	if volumeOptions.ReadOnly {
+		mpUmask = "222"
+	}
+	var defaults mountOptions
+	if pathStyle {
+		defaults = defaults.set("use_path_request_style", "")
+	}
+	defaults = defaults.set("allow_other", "").set("mp_umask", mpUmask)
+	options, err := buildMountOptions(S3fsMounterType, s3fsAllowedOptions, defaults, volumeOptions)
+	if err != nil {
+		return nil, err
+	}
+	if volumeOptions.ReadOnly {
+		options = options.set("ro", "")
+	}
+	return options, nil
 }
 
-//goland:noinspection SpellCheckingInspection
-func (s3fs *s3fsMounter) Unstage(_ string) error {
-	return nil
+func (s3fs *s3fsMounter) Stage(stagePath string) error {
+	keys := s3fs.keys.get()
+	pwFile, err := s3fs.writePasswordFile(keys)
+	if err != nil {
+		return err
+	}
+	files, err := writeTLSFiles(s3fs.volumeId, s3fs.tls)
+	if err != nil {
+		return err
+	}
+	return fuseMount(stagePath, s3fsCmd, s3fs.args(stagePath, pwFile, files), s3fs.envs(files))
 }
 
-func (s3fs *s3fsMounter) Mount(_ string, target string) error {
-	if err := writeS3fsPassword(s3fs.pwFileContent); err != nil {
-		return err
+// writePasswordFile writes the keys into the password file, unless s3fs takes
+// the credentials of the instance role.
+func (s3fs *s3fsMounter) writePasswordFile(keys volumeKeys) (string, error) {
+	if s3fs.iamRole {
+		return "", nil
 	}
+	return writeCredentialsFile(s3fs.volumeId, s3fsPasswordFile, keys.accessKeyID+":"+keys.secretAccessKey)
+}
+
+func (s3fs *s3fsMounter) args(stagePath string, pwFile string, files tlsFiles) []string {
 	args := []string{
 		fmt.Sprintf("%s:/%s", s3fs.metadata.BucketName, s3fs.metadata.FsPathPrefix),
-		target,
-		"-o", "use_path_request_style",
+		stagePath,
+	}
+	if s3fs.iamRole {
+		// s3fs fetches and refreshes the credentials of the instance role itself.
+		args = append(args, "-o", "iam_role=auto")
+	} else {
+		args = append(args, "-o", fmt.Sprintf("passwd_file=%s", pwFile))
+	}
+	args = append(args,
 		"-o", fmt.Sprintf("url=%s", s3fs.url),
 		"-o", fmt.Sprintf("endpoint=%s", s3fs.region),
-		"-o", "allow_other",
-		"-o", "mp_umask=000",
+	)
+	if s3fs.tls.InsecureSkipVerify {
+		args = append(args, "-o", "no_check_certificate", "-o", "ssl_verify_hostname=0")
 	}
-	return fuseMount(target, s3fsCmd, args)
+	// The client certificate requires s3fs 1.93 or later.
+	if len(files.clientCert) != 0 {
+		args = append(args, "-o", fmt.Sprintf("ssl_client_cert=%s:PEM:%s:PEM", files.clientCert, files.clientKey))
+	}
+	for _, option := range s3fs.options {
+		args = append(args, "-o", option.String())
+	}
+	return args
 }
 
-func writeS3fsPassword(pwFileContent string) error {
-	pwFileName := fmt.Sprintf("%s/.passwd-s3fs", os.Getenv("HOME"))
-	pwFile, err := os.OpenFile(pwFileName, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return err
+// envs points libcurl of s3fs to the CA bundle, which s3fs has no option for.
+func (s3fs *s3fsMounter) envs(files tlsFiles) []string {
+	var envs []string
+	if len(files.caBundle) != 0 {
+		envs = append(envs, "CURL_CA_BUNDLE="+files.caBundle)
 	}
-	_, err = pwFile.WriteString(pwFileContent)
-	if err != nil {
-		return err
-	}
-	if pwFile.Close() != nil {
+	return envs
+}
+
+func (s3fs *s3fsMounter) Unstage(ctx context.Context, stagePath string) error {
+	return FuseUmount(ctx, stagePath)
+}
+
+func (s3fs *s3fsMounter) Mount(source string, target string, readonly bool) error {
+	return BindMount(source, target, readonly)
+}
+
+// UpdateCredentials rewrites the password file. s3fs reads the keys once it
+// starts, so the rotated ones are taken when it is launched again, e.g. by the
+// supervisor.
+func (s3fs *s3fsMounter) UpdateCredentials(config *s3.Config) error {
+	if err := ValidateSessionToken(S3fsMounterType, config); err != nil {
 		return err
 	}
-	return nil
+	keys := keysOf(config)
+	s3fs.keys.set(keys)
+	_, err := s3fs.writePasswordFile(keys)
+	return err
 }
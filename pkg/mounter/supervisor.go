@@ -0,0 +1,230 @@
+package mounter
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+)
+
+// Reasons of the events recorded by the supervisor.
+const (
+	ReasonFuseMountBroken   = "FuseMountBroken"
+	ReasonFuseRemounted     = "FuseRemounted"
+	ReasonFuseRemountFailed = "FuseRemountFailed"
+)
+
+const (
+	supervisorInterval = 10 * time.Second
+	remountBackoffBase = 5 * time.Second
+	remountBackoffMax  = 5 * time.Minute
+)
+
+// EventFunc records an event of the volume. The event type is either `Normal`
+// or `Warning`.
+type EventFunc func(volumeId string, eventType string, reason string, message string)
+
+type supervisedMount struct {
+	volumeId string
+	mounter  Mounter
+	// targets holds the target paths bind-mounted from the staging path, and
+	// whether they are read-only.
+	targets     map[string]bool
+	failures    int
+	nextAttempt time.Time
+	// remounting is held during the remount, which runs without the lock of
+	// the supervisor.
+	remounting sync.Mutex
+}
+
+// Supervisor watches the FUSE mounts at the staging paths, and remounts them
+// once their FUSE process exits or the mount turns stale. The target paths are
+// bind-mounted again as well, which only reaches the containers mounting the
+// volume with `HostToContainer` propagation.
+type Supervisor struct {
+	sync.Mutex
+	mounts map[string]*supervisedMount
+	event  EventFunc
+	// remounted is called once the staging path of the volume is remounted.
+	remounted func(volumeId string, stagePath string)
+}
+
+func NewSupervisor(event EventFunc, remounted func(volumeId string, stagePath string)) *Supervisor {
+	return &Supervisor{
+		mounts:    make(map[string]*supervisedMount),
+		event:     event,
+		remounted: remounted,
+	}
+}
+
+// Watch starts watching the FUSE mount of the volume at the staging path. The
+// mounter stages the volume again with the same command and arguments.
+func (s *Supervisor) Watch(volumeId string, stagePath string, mounter Mounter) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.mounts[stagePath]; !ok {
+		s.mounts[stagePath] = &supervisedMount{volumeId: volumeId, mounter: mounter, targets: make(map[string]bool)}
+	}
+}
+
+// Unwatch stops watching the staging path. It waits for the ongoing remount,
+// so that the staging path is not remounted after it is unstaged.
+func (s *Supervisor) Unwatch(stagePath string) {
+	s.Lock()
+	m, ok := s.mounts[stagePath]
+	delete(s.mounts, stagePath)
+	s.Unlock()
+	if ok {
+		m.remounting.Lock()
+		defer m.remounting.Unlock()
+	}
+}
+
+// AddTarget remembers the target path bind-mounted from the staging path.
+func (s *Supervisor) AddTarget(stagePath string, target string, readonly bool) {
+	s.Lock()
+	defer s.Unlock()
+	if m, ok := s.mounts[stagePath]; ok {
+		m.targets[target] = readonly
+	}
+}
+
+// RemoveTarget forgets the target path.
+func (s *Supervisor) RemoveTarget(target string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range s.mounts {
+		delete(m.targets, target)
+	}
+}
+
+// Run checks the watched mounts periodically until stop is closed.
+func (s *Supervisor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(supervisorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+func (s *Supervisor) check() {
+	s.Lock()
+	paths := make([]string, 0, len(s.mounts))
+	for path := range s.mounts {
+		paths = append(paths, path)
+	}
+	s.Unlock()
+
+	for _, path := range paths {
+		// A hanging FUSE mount may block the check, so the lock is not held.
+		broken, reason := isMountBroken(path)
+		if broken {
+			s.recover(path, reason)
+		}
+	}
+}
+
+// isMountBroken reports whether the FUSE mount at the path is stale or its
+// FUSE process has exited.
+func isMountBroken(path string) (bool, string) {
+	if _, err := os.Stat(path); err != nil {
+		if mount.IsCorruptedMnt(err) {
+			return true, fmt.Sprintf("mount point is stale: %s", err)
+		}
+		return false, ""
+	}
+	alive, err := IsFuseProcessAlive(path)
+	if err != nil {
+		klog.Warningf("Unable to check FUSE process of %s: %s", path, err)
+		return false, ""
+	}
+	if !alive {
+		return true, "FUSE process has exited"
+	}
+	return false, ""
+}
+
+// recover remounts the broken mount. The remount may take a while, so the lock
+// is only held to copy the state of the mount and to record the result.
+func (s *Supervisor) recover(path string, reason string) {
+	s.Lock()
+	m, ok := s.mounts[path]
+	if !ok || time.Now().Before(m.nextAttempt) {
+		s.Unlock()
+		return
+	}
+	m.remounting.Lock()
+	defer m.remounting.Unlock()
+	failures := m.failures
+	targets := maps.Clone(m.targets)
+	s.Unlock()
+
+	if failures == 0 {
+		s.event(m.volumeId, "Warning", ReasonFuseMountBroken, fmt.Sprintf("FUSE mount at %s is broken, remounting: %s", path, reason))
+	}
+	err := remount(path, m.mounter, targets)
+
+	s.Lock()
+	watched := s.mounts[path] == m
+	var backoff time.Duration
+	if err != nil {
+		m.failures++
+		backoff = remountBackoff(m.failures)
+		m.nextAttempt = time.Now().Add(backoff)
+	} else {
+		m.failures = 0
+		m.nextAttempt = time.Time{}
+	}
+	s.Unlock()
+	// The volume unstaged meanwhile is left to NodeUnstageVolume.
+	if !watched {
+		return
+	}
+
+	if err != nil {
+		s.event(m.volumeId, "Warning", ReasonFuseRemountFailed, fmt.Sprintf("Failed to remount %s, retrying in %s: %s", path, backoff, err))
+		return
+	}
+	s.remounted(m.volumeId, path)
+	s.event(m.volumeId, "Normal", ReasonFuseRemounted, fmt.Sprintf("FUSE mount at %s has been remounted", path))
+}
+
+// remountBackoff doubles the delay before the next remount with each failure
+// in a row, up to remountBackoffMax.
+func remountBackoff(failures int) time.Duration {
+	if failures >= 10 {
+		return remountBackoffMax
+	}
+	return min(remountBackoffBase<<(failures-1), remountBackoffMax)
+}
+
+// remount lazily unmounts the broken FUSE mount, stages it again, and then
+// bind-mounts the staging path to the target paths again.
+func remount(path string, mounter Mounter, targets map[string]bool) error {
+	if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("failed to unmount %s: %w", path, err)
+	}
+	if err := mounter.Stage(path); err != nil {
+		return err
+	}
+	for target, readonly := range targets {
+		if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil && !errors.Is(err, syscall.EINVAL) {
+			return fmt.Errorf("failed to unmount %s: %w", target, err)
+		}
+		if err := mounter.Mount(path, target, readonly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
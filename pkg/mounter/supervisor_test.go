@@ -0,0 +1,146 @@
+package mounter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/leryn1122/csi-s3/pkg/s3"
+)
+
+// fakeMounter stages the volume without any FUSE process.
+type fakeMounter struct {
+	stageErr error
+	staged   int
+	mounted  map[string]bool
+	// stageHook is called while staging, if any.
+	stageHook func()
+}
+
+func (m *fakeMounter) Stage(string) error {
+	m.staged++
+	if m.stageHook != nil {
+		m.stageHook()
+	}
+	return m.stageErr
+}
+
+func (m *fakeMounter) Unstage(context.Context, string) error {
+	return nil
+}
+
+func (m *fakeMounter) Mount(_ string, target string, readonly bool) error {
+	m.mounted[target] = readonly
+	return nil
+}
+
+func (m *fakeMounter) UpdateCredentials(*s3.Config) error {
+	return nil
+}
+
+func TestRemountBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  5 * time.Second,
+		2:  10 * time.Second,
+		3:  20 * time.Second,
+		6:  160 * time.Second,
+		7:  remountBackoffMax,
+		10: remountBackoffMax,
+		64: remountBackoffMax,
+	}
+	for failures, expected := range cases {
+		if backoff := remountBackoff(failures); backoff != expected {
+			t.Errorf("remountBackoff(%d) = %s, expected %s", failures, backoff, expected)
+		}
+	}
+}
+
+func TestSupervisorRecover(t *testing.T) {
+	var reasons []string
+	var remounted []string
+	s := NewSupervisor(
+		func(_ string, _ string, reason string, _ string) { reasons = append(reasons, reason) },
+		func(volumeId string, _ string) { remounted = append(remounted, volumeId) },
+	)
+	path, target := t.TempDir(), t.TempDir()
+	mounter := &fakeMounter{stageErr: errors.New("endpoint unreachable"), mounted: make(map[string]bool)}
+	s.Watch("volume", path, mounter)
+	s.AddTarget(path, target, true)
+
+	// The failed remount is retried only after the backoff.
+	s.recover(path, "FUSE process has exited")
+	s.recover(path, "FUSE process has exited")
+	m := s.mounts[path]
+	if mounter.staged != 1 || m.failures != 1 || time.Until(m.nextAttempt) <= remountBackoffBase-time.Second {
+		t.Errorf("after a failed remount: staged %d times, %d failures, next attempt in %s", mounter.staged, m.failures, time.Until(m.nextAttempt))
+	}
+
+	m.nextAttempt = time.Now()
+	s.recover(path, "FUSE process has exited")
+	if m.failures != 2 || time.Until(m.nextAttempt) <= 2*remountBackoffBase-time.Second {
+		t.Errorf("after two failed remounts: %d failures, next attempt in %s", m.failures, time.Until(m.nextAttempt))
+	}
+
+	// The successful remount resets the backoff and binds the targets again.
+	mounter.stageErr = nil
+	m.nextAttempt = time.Now()
+	s.recover(path, "FUSE process has exited")
+	if m.failures != 0 || !m.nextAttempt.IsZero() || len(remounted) != 1 || !mounter.mounted[target] {
+		t.Errorf("after the remount: %d failures, next attempt at %s, remounted %v, targets %v", m.failures, m.nextAttempt, remounted, mounter.mounted)
+	}
+	expected := []string{ReasonFuseMountBroken, ReasonFuseRemountFailed, ReasonFuseRemountFailed, ReasonFuseRemounted}
+	if len(reasons) != len(expected) {
+		t.Fatalf("recorded events %v, expected %v", reasons, expected)
+	}
+	for i := range expected {
+		if reasons[i] != expected[i] {
+			t.Errorf("recorded events %v, expected %v", reasons, expected)
+			break
+		}
+	}
+}
+
+func TestSupervisorRemountWithoutLock(t *testing.T) {
+	var remounted []string
+	s := NewSupervisor(
+		func(string, string, string, string) {},
+		func(volumeId string, _ string) { remounted = append(remounted, volumeId) },
+	)
+	path := t.TempDir()
+	started, release := make(chan struct{}), make(chan struct{})
+	mounter := &fakeMounter{mounted: make(map[string]bool), stageHook: func() {
+		close(started)
+		<-release
+	}}
+	s.Watch("volume", path, mounter)
+
+	recovered := make(chan struct{})
+	go func() {
+		s.recover(path, "FUSE process has exited")
+		close(recovered)
+	}()
+	<-started
+
+	// The other volumes are watched while the remount is ongoing, but the
+	// unstaged one waits for it.
+	s.Watch("other", t.TempDir(), &fakeMounter{mounted: make(map[string]bool)})
+	s.AddTarget(path, t.TempDir(), false)
+	unwatched := make(chan struct{})
+	go func() {
+		s.Unwatch(path)
+		close(unwatched)
+	}()
+	select {
+	case <-unwatched:
+		t.Errorf("Unwatch returned during the remount")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	<-recovered
+	<-unwatched
+	if len(remounted) != 0 {
+		t.Errorf("remounted %v, expected none after the volume is unwatched", remounted)
+	}
+}
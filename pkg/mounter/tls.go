@@ -0,0 +1,62 @@
+package mounter
+
+import (
+	"fmt"
+
+	"github.com/leryn1122/csi-s3/pkg/s3"
+)
+
+const (
+	caBundleFile   = "ca.crt"
+	clientCertFile = "client.crt"
+	clientKeyFile  = "client.key"
+)
+
+// tlsFiles are the TLS files of the volume handed to the FUSE process, where
+// the ones not given are empty.
+type tlsFiles struct {
+	caBundle   string
+	clientCert string
+	clientKey  string
+}
+
+// writeTLSFiles writes the CA bundle and the client certificate of the volume
+// next to its credentials.
+func writeTLSFiles(volumeId string, config s3.TLSConfig) (tlsFiles, error) {
+	var files tlsFiles
+	for _, file := range []struct {
+		path    *string
+		name    string
+		content string
+	}{
+		{&files.caBundle, caBundleFile, config.CABundle},
+		{&files.clientCert, clientCertFile, config.ClientCert},
+		{&files.clientKey, clientKeyFile, config.ClientKey},
+	} {
+		if len(file.content) == 0 {
+			continue
+		}
+		path, err := writeCredentialsFile(volumeId, file.name, file.content)
+		if err != nil {
+			return tlsFiles{}, err
+		}
+		*file.path = path
+	}
+	return files, nil
+}
+
+// ValidateTLS validates that the mounter supports the TLS settings, since the
+// mounters differ in what they are able to configure.
+func ValidateTLS(mounterType string, config s3.TLSConfig) error {
+	if mounterType != GoofysMounterType {
+		return nil
+	}
+	// goofys only honors the CA bundle given by `SSL_CERT_FILE`.
+	if config.InsecureSkipVerify {
+		return fmt.Errorf("mounter %s is unable to skip the verification of the server certificate", mounterType)
+	}
+	if len(config.ClientCert) != 0 {
+		return fmt.Errorf("mounter %s supports no client certificate", mounterType)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package mounter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+)
+
+// fuseExitTimeout bounds the wait for the FUSE process to exit once unmounted,
+// after which it is killed.
+const fuseExitTimeout = 30 * time.Second
+
+// Unmount unmounts the bind mount at the target path and removes the target
+// directory. The busy or corrupted mount is detached lazily.
+func Unmount(path string) error {
+	err := mount.CleanupMountPoint(path, mount.New(""), false)
+	if err == nil {
+		return nil
+	}
+	klog.Warningf("Failed to unmount %s, detaching it lazily: %s", path, err)
+	if err = lazyUnmount(path); err != nil {
+		return err
+	}
+	return removeMountPoint(path)
+}
+
+// FuseUmount unmounts the FUSE mount at the path, waits for its FUSE process to
+// exit, and then removes the directory. It succeeds if nothing is mounted. The
+// busy mount, or the corrupted one whose FUSE process is gone, is detached
+// lazily.
+func FuseUmount(ctx context.Context, path string) error {
+	state, _, err := InspectMount(mount.New(""), path, "")
+	if err != nil {
+		return err
+	}
+	// The process and the connection are looked up ahead, as they are unknown
+	// once unmounted.
+	pid := fuseMountPID(path)
+	connection, err := fuseConnection(path)
+	if err != nil {
+		klog.Warningf("Unable to find FUSE connection of %s: %s", path, err)
+	}
+
+	switch state {
+	case NotMounted:
+		klog.Infof("%s is not mounted", path)
+	case Corrupted:
+		klog.Warningf("FUSE mount %s is corrupted, detaching it lazily", path)
+		if err = lazyUnmount(path); err != nil {
+			return err
+		}
+	default:
+		if err = mount.New("").Unmount(path); err != nil {
+			klog.Warningf("Failed to unmount %s, detaching it lazily: %s", path, err)
+			if err = lazyUnmount(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	removeUnitEnvFile(path)
+	fuseMounts.Delete(path)
+	if state != NotMounted {
+		waitForFuseExit(ctx, path, pid, connection)
+	}
+	return removeMountPoint(path)
+}
+
+// lazyUnmount detaches the mount at the path, by fusermount if available.
+func lazyUnmount(path string) error {
+	for _, command := range []string{"fusermount3", "fusermount"} {
+		if _, err := exec.LookPath(command); err != nil {
+			continue
+		}
+		out, err := exec.Command(command, "-uz", path).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		klog.Warningf("%s -uz %s failed: %s", command, path, strings.TrimSpace(string(out)))
+		break
+	}
+	if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("failed to detach %s: %w", path, err)
+	}
+	return nil
+}
+
+func removeMountPoint(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// waitForFuseExit waits for the FUSE process to exit until the context is done
+// or fuseExitTimeout passes, and kills it then, aborting its connection if it
+// hangs. The process is verified to still mount the path before each check,
+// as its PID may be reused once it exits. The FUSE process launched by
+// systemd-run is tracked by its unit, since it is invisible from the plugin.
+func waitForFuseExit(ctx context.Context, path string, pid int, connection int) {
+	alive := func() bool { return isProcessAlive(pid) && servesFuseMount(pid, path, connection) }
+	kill := func() error { return killFuseProcess(pid, path, connection) }
+	if launcher == LauncherSystemd {
+		unit := unitName(path)
+		alive = func() bool { return isUnitActive(path) }
+		kill = func() error { return exec.Command("systemctl", "kill", "--signal=SIGKILL", unit).Run() }
+	} else if pid == 0 {
+		klog.Warningf("Unable to find PID of FUSE mount %s, it must be already finished", path)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fuseExitTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for alive() {
+		select {
+		case <-ctx.Done():
+			klog.Warningf("FUSE process of %s is still running after unmount, killing it", path)
+			if err := kill(); err != nil {
+				klog.Errorf("Failed to kill FUSE process of %s: %s", path, err)
+			}
+			if connection != 0 {
+				if err := abortFuseConnection(connection); err != nil && !os.IsNotExist(err) {
+					klog.Warningf("Failed to abort FUSE connection %d of %s: %s", connection, path, err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+	klog.Infof("FUSE process of %s has exited", path)
+}
+
+// killFuseProcess kills the FUSE process of the connection mounted at the path.
+// The process is held by a pidfd while it is verified, so that another process
+// taking over its PID is never killed.
+func killFuseProcess(pid int, path string, connection int) error {
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	switch {
+	case errors.Is(err, unix.ESRCH):
+		return nil
+	case errors.Is(err, unix.ENOSYS):
+		// The kernels before 5.3 lack pidfds.
+		if !servesFuseMount(pid, path, connection) {
+			return nil
+		}
+		return syscall.Kill(pid, syscall.SIGKILL)
+	case err != nil:
+		return err
+	}
+	defer unix.Close(pidfd)
+	if !servesFuseMount(pid, path, connection) {
+		klog.Infof("Process %d no longer mounts %s, it has exited", pid, path)
+		return nil
+	}
+	return unix.PidfdSendSignal(pidfd, unix.SIGKILL, nil, 0)
+}
+
+// isProcessAlive reports whether the process runs. A zombie, e.g. an orphaned
+// FUSE daemon adopted by the driver running as PID 1, is reaped and counted as
+// exited.
+func isProcessAlive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name in parentheses, which may contain
+	// spaces.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) > 0 && fields[0] == "Z" {
+		_, _ = syscall.Wait4(pid, nil, syscall.WNOHANG, nil)
+		return false
+	}
+	return true
+}
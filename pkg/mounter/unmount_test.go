@@ -0,0 +1,30 @@
+package mounter
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestWaitForFuseExitSparesReusedPID(t *testing.T) {
+	// The process took over the PID of the FUSE process, which has exited.
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	path := t.TempDir()
+	waitForFuseExit(ctx, path, cmd.Process.Pid, 0)
+	if err := killFuseProcess(cmd.Process.Pid, path, 0); err != nil {
+		t.Errorf("killFuseProcess failed: %v", err)
+	}
+	if !isProcessAlive(cmd.Process.Pid) {
+		t.Error("the process not mounting the path has been killed")
+	}
+}
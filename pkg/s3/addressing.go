@@ -0,0 +1,55 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// Addressing styles of the buckets. The path style puts the bucket into the
+// path of the endpoint, while the virtual-hosted style puts it into the host.
+const (
+	AddressingStyleAuto    = "auto"
+	AddressingStylePath    = "path"
+	AddressingStyleVirtual = "virtual"
+)
+
+// ValidateAddressingStyle validates the addressing style, where the empty one
+// is auto.
+func ValidateAddressingStyle(style string) error {
+	switch style {
+	case "", AddressingStyleAuto, AddressingStylePath, AddressingStyleVirtual:
+		return nil
+	}
+	return fmt.Errorf("unknown addressing style %s, expected one of %s, %s and %s",
+		style, AddressingStyleAuto, AddressingStylePath, AddressingStyleVirtual)
+}
+
+func (config *Config) bucketLookup() minio.BucketLookupType {
+	switch config.AddressingStyle {
+	case AddressingStylePath:
+		return minio.BucketLookupPath
+	case AddressingStyleVirtual:
+		return minio.BucketLookupDNS
+	}
+	return minio.BucketLookupAuto
+}
+
+// UsePathStyle reports whether the bucket is addressed in path style. The auto
+// style picks the virtual-hosted style for the providers known to support it,
+// like the S3 client does, and the path style otherwise.
+func (config *Config) UsePathStyle() bool {
+	switch config.AddressingStyle {
+	case AddressingStylePath:
+		return true
+	case AddressingStyleVirtual:
+		return false
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return true
+	}
+	return !s3utils.IsVirtualHostSupported(*endpoint, config.Bucket)
+}
@@ -0,0 +1,27 @@
+package s3
+
+import "testing"
+
+func TestUsePathStyle(t *testing.T) {
+	cases := []struct {
+		style    string
+		endpoint string
+		bucket   string
+		expected bool
+	}{
+		{"", "http://127.0.0.1:9000", "bucket", true},
+		{AddressingStyleAuto, "https://s3.us-east-1.amazonaws.com", "bucket", false},
+		{AddressingStyleAuto, "https://s3.us-east-1.amazonaws.com", "bucket.with.dots", true},
+		{AddressingStylePath, "https://s3.us-east-1.amazonaws.com", "bucket", true},
+		{AddressingStyleVirtual, "http://127.0.0.1:9000", "bucket", false},
+	}
+	for _, c := range cases {
+		config := &Config{Endpoint: c.endpoint, Bucket: c.bucket, AddressingStyle: c.style}
+		if pathStyle := config.UsePathStyle(); pathStyle != c.expected {
+			t.Errorf("UsePathStyle() of %+v = %v, expected %v", config, pathStyle, c.expected)
+		}
+	}
+	if err := ValidateAddressingStyle("subdomain"); err == nil {
+		t.Errorf("ValidateAddressingStyle(%q) succeeded, expected an error", "subdomain")
+	}
+}
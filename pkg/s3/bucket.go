@@ -0,0 +1,33 @@
+package s3
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// Prefixes and suffixes of the bucket names reserved by AWS S3.
+var (
+	reservedBucketNamePrefixes = []string{"xn--", "sthree-"}
+	reservedBucketNameSuffixes = []string{"-s3alias", "--ol-s3"}
+)
+
+// ValidateBucketName checks the bucket name against the S3 bucket naming rules.
+// - https://docs.aws.amazon.com/AmazonS3/latest/userguide/bucketnamingrules.html
+func ValidateBucketName(name string) error {
+	if err := s3utils.CheckValidBucketNameStrict(name); err != nil {
+		return fmt.Errorf("invalid bucket name `%s`: %w", name, err)
+	}
+	for _, prefix := range reservedBucketNamePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return fmt.Errorf("invalid bucket name `%s`: prefix `%s` is reserved", name, prefix)
+		}
+	}
+	for _, suffix := range reservedBucketNameSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return fmt.Errorf("invalid bucket name `%s`: suffix `%s` is reserved", name, suffix)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package s3
+
+import "testing"
+
+func TestValidateBucketName(t *testing.T) {
+	cases := map[string]bool{
+		"csi-s3driver":        true,
+		"default-pvc-0.data":  true,
+		"ab":                  false,
+		"Default-PVC":         false,
+		"default_pvc":         false,
+		"-default-pvc":        false,
+		"default..pvc":        false,
+		"192.168.1.1":         false,
+		"xn--default-pvc":     false,
+		"default-pvc-s3alias": false,
+		"default-pvc--ol-s3":  false,
+		"a-very-long-bucket-name-" + "that-exceeds-the-limit-of-sixty-three-chars": false,
+	}
+	for name, valid := range cases {
+		if err := ValidateBucketName(name); (err == nil) != valid {
+			t.Errorf("ValidateBucketName(%q) = %v, expected valid: %v", name, err, valid)
+		}
+	}
+}
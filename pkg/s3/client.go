@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/leryn1122/csi-s3/pkg/constant"
 	"io"
+	"net/http"
 	"net/url"
+	"path"
+	"strings"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -17,23 +19,34 @@ import (
 
 const (
 	defaultFSPathPrefix = "csi-fs"
-	metadataName        = defaultFSPathPrefix + "/" + "metadata.json"
+	metadataName        = "metadata.json"
 )
 
+// MetadataPrefix holds the metadata of the volumes with a prefix, out of the
+// prefixes mounted by the workloads, which must neither read nor rewrite it.
+const MetadataPrefix = ".csi-meta"
+
 // Config holds values to configure the driver
 type Config struct {
 	Bucket          string
 	AccessKeyID     string
 	SecretAccessKey string
-	Region          string
-	Endpoint        string
-	Mounter         string
+	// SessionToken is the session token of temporary keys.
+	SessionToken string
+	Region       string
+	Endpoint     string
+	Mounter      string
+	// AddressingStyle is either auto, path or virtual.
+	AddressingStyle string
+	TLS             TLSConfig
+	Credentials     CredentialsConfig
 }
 
 //goland:noinspection GoNameStartsWithPackageName
 type S3Client struct {
 	Config *Config
 	minio  *minio.Client
+	creds  *credentials.Credentials
 	ctx    context.Context
 }
 
@@ -42,9 +55,21 @@ type Metadata struct {
 	FsPathPrefix  string `json:"fsPathPrefix"`
 	CapacityBytes int64  `json:"capacityBytes"`
 	Mounter       string `json:"mounter"`
+	OnDelete      string `json:"onDelete,omitempty"`
+	VolumeId      string `json:"volumeId,omitempty"`
 }
 
 func newS3Client(config *Config) (*S3Client, error) {
+	if err := ValidateAddressingStyle(config.AddressingStyle); err != nil {
+		return nil, err
+	}
+	if err := config.validateCredentials(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := config.TLS.clientConfig()
+	if err != nil {
+		return nil, err
+	}
 	u, err := url.Parse(config.Endpoint)
 	if err != nil {
 		return nil, err
@@ -57,10 +82,21 @@ func newS3Client(config *Config) (*S3Client, error) {
 		endpoint = u.Hostname()
 	}
 
+	secure := u.Scheme == "https"
+	transport, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	creds := config.credentials(&http.Client{Transport: transport})
 	options := &minio.Options{
-		Creds:  credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, config.Region),
-		Region: config.Region,
-		Secure: u.Scheme == "https",
+		Creds:        creds,
+		Region:       config.Region,
+		Secure:       secure,
+		BucketLookup: config.bucketLookup(),
+		Transport:    transport,
 	}
 
 	var minioClient *minio.Client
@@ -70,20 +106,70 @@ func newS3Client(config *Config) (*S3Client, error) {
 	client := &S3Client{
 		Config: config,
 		minio:  minioClient,
+		creds:  creds,
+		ctx:    context.Background(),
 	}
 	return client, err
 }
 
 func NewClientFromSecrets(secrets map[string]string) (*S3Client, error) {
+	config, err := ConfigFromSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+	return newS3Client(config)
+}
+
+// ConfigFromSecrets builds the config from the secrets, and validates the
+// settings given by users rather than by the endpoint, so that a volume with
+// invalid ones fails to be created.
+func ConfigFromSecrets(secrets map[string]string) (*Config, error) {
+	insecureSkipVerify, err := parseBool(constant.InsecureSkipVerifyKey, secrets[constant.InsecureSkipVerifyKey])
+	if err != nil {
+		return nil, err
+	}
 	// Mounter is set in the volume preferences, not secrets
-	return newS3Client(&Config{
+	config := &Config{
 		Bucket:          secrets[constant.BucketKey],
 		AccessKeyID:     secrets["accessKeyID"],
 		SecretAccessKey: secrets["secretAccessKey"],
+		SessionToken:    secrets[constant.SessionTokenKey],
 		Region:          secrets["region"],
 		Endpoint:        secrets["endpoint"],
 		Mounter:         secrets[constant.TypeKey],
-	})
+		AddressingStyle: secrets[constant.AddressingStyleKey],
+		TLS: TLSConfig{
+			CABundle:           secrets[constant.CABundleKey],
+			InsecureSkipVerify: insecureSkipVerify,
+			ClientCert:         secrets[constant.TLSClientCertKey],
+			ClientKey:          secrets[constant.TLSClientKeyKey],
+		},
+		Credentials: CredentialsConfig{
+			Provider:             secrets[constant.CredentialProviderKey],
+			Path:                 secrets[constant.CredentialsPathKey],
+			RoleARN:              secrets[constant.RoleARNKey],
+			RoleSessionName:      secrets[constant.RoleSessionNameKey],
+			ExternalID:           secrets[constant.ExternalIDKey],
+			STSEndpoint:          secrets[constant.STSEndpointKey],
+			WebIdentityTokenFile: secrets[constant.WebIdentityTokenFileKey],
+			LDAPUsername:         secrets[constant.LDAPUsernameKey],
+			LDAPPassword:         secrets[constant.LDAPPasswordKey],
+		},
+	}
+	config.Credentials.credentialsFromEnv()
+	if err = config.readCredentials(); err != nil {
+		return nil, err
+	}
+	if err = ValidateAddressingStyle(config.AddressingStyle); err != nil {
+		return nil, err
+	}
+	if err = config.validateCredentials(); err != nil {
+		return nil, err
+	}
+	if _, err = config.TLS.clientConfig(); err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
 func (client *S3Client) bucketExists() (bool, error) {
@@ -120,30 +206,16 @@ func (client *S3Client) removeBucket() error {
 
 func (client *S3Client) emptyBucket() error {
 	bucket := client.Config.Bucket
-	objectsCh := make(chan minio.ObjectInfo)
-	var listErr error
-
-	go func() {
-		defer close(objectsCh)
-
-		for object := range client.minio.ListObjects(context.Background(), bucket, minio.ListObjectsOptions{Recursive: true}) {
-			if object.Err != nil {
-				listErr = object.Err
-				return
-			}
-			objectsCh <- object
-		}
-	}()
-
-	if listErr != nil {
-		klog.Errorf("Error listing objects: %v", listErr)
-		return listErr
-	}
+	objectsCh, listErr := client.listObjectsToRemove("")
 
 	errorCh := client.minio.RemoveObjects(context.Background(), bucket, objectsCh, minio.RemoveObjectsOptions{})
 	for e := range errorCh {
 		klog.Errorf("Failed to remove object %q, error: %v", e.ObjectName, e.Err)
 	}
+	if err := listErr(); err != nil {
+		klog.Errorf("Error listing objects: %v", err)
+		return err
+	}
 	if len(errorCh) != 0 {
 		return fmt.Errorf("failed to remove all objects of bucket %s", bucket)
 	}
@@ -152,10 +224,21 @@ func (client *S3Client) emptyBucket() error {
 	return client.minio.RemoveObject(context.Background(), bucket, defaultFSPathPrefix, minio.RemoveObjectOptions{})
 }
 
-func (client *S3Client) metadataExist() bool {
+// metadataPath returns where the metadata of the volume with the prefix is
+// stored. The volumes of the whole bucket keep it under `csi-fs`, while the
+// ones with a prefix keep it under MetadataPrefix, e.g. `csi-fs/pvc-a` keeps it
+// at `.csi-meta/csi-fs/pvc-a.json`.
+func metadataPath(prefix string) string {
+	if len(prefix) == 0 {
+		return path.Join(defaultFSPathPrefix, metadataName)
+	}
+	return path.Join(MetadataPrefix, prefix) + ".json"
+}
+
+func (client *S3Client) metadataExist(prefix string) bool {
 	listOpts := minio.ListObjectsOptions{
 		Recursive: false,
-		Prefix:    metadataName,
+		Prefix:    metadataPath(prefix),
 	}
 	for objs := range client.minio.ListObjects(context.Background(), client.Config.Bucket, listOpts) {
 		if objs.Err != nil {
@@ -199,6 +282,7 @@ func (client *S3Client) RemoveBucket() error {
 	return err
 }
 
+// SetMetadata stores the metadata under the prefix of the volume.
 func (client *S3Client) SetMetadata(metadata *Metadata) error {
 	b := new(bytes.Buffer)
 	if err := json.NewEncoder(b).Encode(metadata); err != nil {
@@ -207,24 +291,25 @@ func (client *S3Client) SetMetadata(metadata *Metadata) error {
 	options := minio.PutObjectOptions{
 		ContentType: "application/json",
 	}
-	_, err := client.minio.PutObject(context.Background(), client.Config.Bucket, metadataName, b, int64(b.Len()), options)
+	_, err := client.minio.PutObject(context.Background(), client.Config.Bucket, metadataPath(metadata.FsPathPrefix), b, int64(b.Len()), options)
 	return err
 }
 
-func (client *S3Client) GetMetadata() (*Metadata, error) {
+// GetMetadata fetches the metadata of the volume with the prefix.
+func (client *S3Client) GetMetadata(prefix string) (*Metadata, error) {
+	return client.getMetadata(metadataPath(prefix))
+}
+
+func (client *S3Client) getMetadata(key string) (*Metadata, error) {
 	opts := minio.GetObjectOptions{}
-	obj, err := client.minio.GetObject(context.Background(), client.Config.Bucket, metadataName, opts)
+	obj, err := client.minio.GetObject(context.Background(), client.Config.Bucket, key, opts)
 	if err != nil {
 		return nil, err
 	}
-	objInfo, err := obj.Stat()
-	if err != nil {
-		return nil, err
-	}
-	b := make([]byte, objInfo.Size)
-	_, err = obj.Read(b)
+	defer obj.Close()
 
-	if err != nil && !errors.Is(err, io.EOF) {
+	b, err := io.ReadAll(obj)
+	if err != nil {
 		return nil, err
 	}
 	var metadata Metadata
@@ -232,72 +317,225 @@ func (client *S3Client) GetMetadata() (*Metadata, error) {
 	return &metadata, err
 }
 
+// RemoveMetadata removes the metadata of the volume with the prefix, so that
+// the volume is no longer tracked.
+func (client *S3Client) RemoveMetadata(prefix string) error {
+	return client.minio.RemoveObject(client.ctx, client.Config.Bucket, metadataPath(prefix), minio.RemoveObjectOptions{})
+}
+
+// ListMetadata lists the metadata of all volumes in the bucket. Only the
+// metadata of the whole bucket and the objects under MetadataPrefix are read,
+// so that the data of the volumes is never listed. The metadata found at the
+// path of another volume is ignored.
+func (client *S3Client) ListMetadata() ([]*Metadata, error) {
+	var metadataList []*Metadata
+	metadata, err := client.GetMetadata("")
+	switch {
+	case err == nil && len(metadata.VolumeId) != 0 && len(metadata.FsPathPrefix) == 0:
+		metadataList = append(metadataList, metadata)
+	case err != nil && !IsNotFound(err):
+		return nil, err
+	}
+
+	for object := range client.minio.ListObjects(client.ctx, client.Config.Bucket, minio.ListObjectsOptions{Prefix: MetadataPrefix + "/", Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		metadata, err := client.getMetadata(object.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(metadata.VolumeId) == 0 || metadataPath(metadata.FsPathPrefix) != object.Key {
+			continue
+		}
+		metadataList = append(metadataList, metadata)
+	}
+	return metadataList, nil
+}
+
+// IsNotFound reports whether the error is caused by a missing bucket or object.
+func IsNotFound(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchBucket", "NoSuchKey":
+		return true
+	}
+	return false
+}
+
+// IsAccessDenied reports whether the credentials are rejected by the endpoint.
+func IsAccessDenied(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+		return true
+	}
+	return false
+}
+
 // CreatePrefix Create an empty "directory".
-func (client *S3Client) CreatePrefix() error {
-	klog.Infof("Prefix: %s", defaultFSPathPrefix)
-	_, err := client.minio.PutObject(context.Background(), client.Config.Bucket, defaultFSPathPrefix+"/", bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
+// The volumes of the whole bucket use `csi-fs` with an empty prefix.
+func (client *S3Client) CreatePrefix(prefix string) error {
+	if len(prefix) == 0 {
+		prefix = defaultFSPathPrefix
+	}
+	klog.Infof("Prefix: %s", prefix)
+	_, err := client.minio.PutObject(context.Background(), client.Config.Bucket, dirPrefix(prefix), bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// RemovePrefix removes all objects under the prefix. An empty prefix removes
+// all objects of the bucket, but keeps the bucket itself.
 func (client *S3Client) RemovePrefix(prefix string) error {
-	bucket := client.Config.Bucket
+	prefix = dirPrefix(prefix)
 
 	var err error
 	if err = client.removeObjects(prefix); err == nil {
-		return client.minio.RemoveObject(client.ctx, bucket, prefix, minio.RemoveObjectOptions{})
+		return client.removePrefixObject(prefix)
 	}
 
 	klog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
 
 	if err = client.removeObjectsOneByOne(prefix); err == nil {
-		return client.minio.RemoveObject(client.ctx, bucket, prefix, minio.RemoveObjectOptions{})
+		return client.removePrefixObject(prefix)
 	}
 	return err
 }
 
-func (client *S3Client) removeObjects(prefix string) error {
+// maxCopyObjectSize is the largest object copied at once by CopyObject.
+const maxCopyObjectSize = 5 << 30
+
+// ArchivePrefix copies all objects under the prefix to the archive prefix,
+// and then removes the origin ones. Objects already under the archive prefix
+// are left untouched.
+func (client *S3Client) ArchivePrefix(prefix string, archivePrefix string) error {
 	bucket := client.Config.Bucket
+	prefix = dirPrefix(prefix)
+	archivePrefix = dirPrefix(archivePrefix)
+
+	for object := range client.minio.ListObjects(client.ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if strings.HasPrefix(object.Key, archivePrefix) {
+			continue
+		}
+		dst := minio.CopyDestOptions{Bucket: bucket, Object: archivePrefix + object.Key}
+		src := minio.CopySrcOptions{Bucket: bucket, Object: object.Key}
+		var err error
+		if object.Size > maxCopyObjectSize {
+			// The large object is copied in parts on the server.
+			_, err = client.minio.ComposeObject(client.ctx, dst, src)
+		} else {
+			_, err = client.minio.CopyObject(client.ctx, dst, src)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to archive object %s: %w", object.Key, err)
+		}
+		if err = client.minio.RemoveObject(client.ctx, bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("failed to remove archived object %s: %w", object.Key, err)
+		}
+	}
+	return nil
+}
 
+// PrefixUsage sums the sizes and counts the objects under the prefix. An empty
+// prefix covers the whole bucket.
+func (client *S3Client) PrefixUsage(prefix string) (int64, int64, error) {
+	var size, count int64
+	for object := range client.minio.ListObjects(client.ctx, client.Config.Bucket, minio.ListObjectsOptions{Prefix: dirPrefix(prefix), Recursive: true}) {
+		if object.Err != nil {
+			return 0, 0, object.Err
+		}
+		size += object.Size
+		count++
+	}
+	return size, count, nil
+}
+
+// BucketUnused reports whether the bucket holds no objects but the prefix of
+// the volumes of the whole bucket, e.g. left by a failed CreateVolume.
+func (client *S3Client) BucketUnused() (bool, error) {
+	ctx, cancel := context.WithCancel(client.ctx)
+	defer cancel()
+	for object := range client.minio.ListObjects(ctx, client.Config.Bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return false, object.Err
+		}
+		if object.Key != dirPrefix(defaultFSPathPrefix) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (client *S3Client) removePrefixObject(prefix string) error {
+	if len(prefix) == 0 {
+		return nil
+	}
+	return client.minio.RemoveObject(client.ctx, client.Config.Bucket, prefix, minio.RemoveObjectOptions{})
+}
+
+// dirPrefix appends the trailing slash to the prefix, so that `csi-fs` never
+// matches objects of `csi-fs2`.
+func dirPrefix(prefix string) string {
+	if len(prefix) == 0 || strings.HasSuffix(prefix, "/") {
+		return prefix
+	}
+	return prefix + "/"
+}
+
+// listObjectsToRemove feeds the objects under the prefix to the channel. The
+// returned function tells whether the listing failed, and must only be called
+// once the channel has been drained, as the listing may fail partway.
+func (client *S3Client) listObjectsToRemove(prefix string) (<-chan minio.ObjectInfo, func() error) {
 	objectsCh := make(chan minio.ObjectInfo)
-	var listErr error
+	listErrCh := make(chan error, 1)
 
 	go func() {
+		defer close(listErrCh)
 		defer close(objectsCh)
 
 		for object := range client.minio.ListObjects(
 			client.ctx,
-			bucket,
+			client.Config.Bucket,
 			minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
 			if object.Err != nil {
-				listErr = object.Err
+				listErrCh <- object.Err
 				return
 			}
 			objectsCh <- object
 		}
 	}()
 
-	if listErr != nil {
-		klog.Error("Error listing objects", listErr)
-		return listErr
+	return objectsCh, func() error {
+		return <-listErrCh
 	}
+}
 
-	select {
-	default:
-		opts := minio.RemoveObjectsOptions{
-			GovernanceBypass: true,
-		}
-		errorCh := client.minio.RemoveObjects(client.ctx, bucket, objectsCh, opts)
-		haveErrWhenRemoveObjects := false
-		for e := range errorCh {
-			klog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
-			haveErrWhenRemoveObjects = true
-		}
-		if haveErrWhenRemoveObjects {
-			return fmt.Errorf("failed to remove all objects of bucket %s", bucket)
-		}
+func (client *S3Client) removeObjects(prefix string) error {
+	bucket := client.Config.Bucket
+	objectsCh, listErr := client.listObjectsToRemove(prefix)
+
+	opts := minio.RemoveObjectsOptions{
+		GovernanceBypass: true,
+	}
+	errorCh := client.minio.RemoveObjects(client.ctx, bucket, objectsCh, opts)
+	haveErrWhenRemoveObjects := false
+	for e := range errorCh {
+		klog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
+		haveErrWhenRemoveObjects = true
+	}
+	if err := listErr(); err != nil {
+		klog.Error("Error listing objects", err)
+		return err
+	}
+	if haveErrWhenRemoveObjects {
+		return fmt.Errorf("failed to remove all objects of bucket %s", bucket)
 	}
 	return nil
 }
@@ -305,27 +543,8 @@ func (client *S3Client) removeObjects(prefix string) error {
 func (client *S3Client) removeObjectsOneByOne(prefix string) error {
 	bucket := client.Config.Bucket
 
-	objectsCh := make(chan minio.ObjectInfo, 1)
+	objectsCh, listErr := client.listObjectsToRemove(prefix)
 	removeErrCh := make(chan minio.RemoveObjectError, 1)
-	var listErr error
-
-	go func() {
-		defer close(objectsCh)
-
-		for object := range client.minio.ListObjects(client.ctx, bucket,
-			minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
-			if object.Err != nil {
-				listErr = object.Err
-				return
-			}
-			objectsCh <- object
-		}
-	}()
-
-	if listErr != nil {
-		klog.Error("Error listing objects", listErr)
-		return listErr
-	}
 
 	go func() {
 		defer close(removeErrCh)
@@ -348,6 +567,10 @@ func (client *S3Client) removeObjectsOneByOne(prefix string) error {
 		klog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
 		haveErrWhenRemoveObjects = true
 	}
+	if err := listErr(); err != nil {
+		klog.Error("Error listing objects", err)
+		return err
+	}
 	if haveErrWhenRemoveObjects {
 		return fmt.Errorf("failed to remove all objects of path %s", bucket)
 	}
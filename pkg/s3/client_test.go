@@ -0,0 +1,164 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestClient creates the client of the bucket served by the fake endpoint.
+func newTestClient(t *testing.T, endpoint string) *S3Client {
+	client, err := NewClientFromSecrets(map[string]string{
+		"endpoint":        endpoint,
+		"region":          "us-east-1",
+		"accessKeyID":     "key",
+		"secretAccessKey": "secret",
+		"addressingStyle": "path",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Config.Bucket = "bucket"
+	return client
+}
+
+// fakeArchiveBucket serves the objects of a bucket, and records the copies of
+// the archive.
+type fakeArchiveBucket struct {
+	sync.Mutex
+	sizes                      map[string]int64
+	copies, copiedParts, moved int
+}
+
+func (bucket *fakeArchiveBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket.Lock()
+	defer bucket.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && query.Has("list-type"):
+		contents := ""
+		for key, size := range bucket.sizes {
+			contents += fmt.Sprintf("<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, size)
+		}
+		_, _ = w.Write([]byte("<ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>" + contents + "</ListBucketResult>"))
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", strconv.FormatInt(bucket.sizes[key], 10))
+		w.Header().Set("Last-Modified", "Mon, 2 Jan 2006 15:04:05 GMT")
+		w.Header().Set("ETag", `"source"`)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		_, _ = w.Write([]byte("<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>" + key + "</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		bucket.copiedParts++
+		_, _ = w.Write([]byte(`<CopyPartResult><ETag>"part"</ETag><LastModified>2006-01-02T15:04:05Z</LastModified></CopyPartResult>`))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		_, _ = w.Write([]byte("<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>" + key + `</Key><ETag>"archive"</ETag></CompleteMultipartUploadResult>`))
+	case r.Method == http.MethodPut:
+		bucket.copies++
+		_, _ = w.Write([]byte(`<CopyObjectResult><ETag>"archive"</ETag><LastModified>2006-01-02T15:04:05Z</LastModified></CopyObjectResult>`))
+	case r.Method == http.MethodDelete:
+		bucket.moved++
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestArchivePrefixLargeObjects(t *testing.T) {
+	bucket := &fakeArchiveBucket{sizes: map[string]int64{
+		"csi-fs/pvc/small": 1 << 10,
+		"csi-fs/pvc/large": 6 << 30,
+	}}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	client := newTestClient(t, server.URL)
+	if err := client.ArchivePrefix("csi-fs/pvc", "csi-archive/pvc"); err != nil {
+		t.Fatalf("ArchivePrefix failed: %v", err)
+	}
+	if bucket.copies != 1 || bucket.copiedParts < 2 || bucket.moved != 2 {
+		t.Errorf("archived with %d copies and %d copied parts, removing %d objects, expected 1 copy, the large object in parts and 2 removals",
+			bucket.copies, bucket.copiedParts, bucket.moved)
+	}
+}
+
+func TestMetadataPath(t *testing.T) {
+	cases := map[string]string{
+		"":             "csi-fs/metadata.json",
+		"csi-fs/pvc-a": ".csi-meta/csi-fs/pvc-a.json",
+		"team/a/pvc-b": ".csi-meta/team/a/pvc-b.json",
+	}
+	for prefix, expected := range cases {
+		if key := metadataPath(prefix); key != expected {
+			t.Errorf("metadataPath(%q) = %s, expected %s", prefix, key, expected)
+		}
+	}
+}
+
+func TestRemovePrefixListingFailure(t *testing.T) {
+	var removed atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodGet && query.Has("continuation-token"):
+			// The listing fails after its first page.
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<Error><Code>AccessDenied</Code></Error>`))
+		case r.Method == http.MethodGet && query.Has("list-type"):
+			_, _ = w.Write([]byte(`<ListBucketResult><Name>bucket</Name><IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken>` +
+				`<Contents><Key>csi-fs/pvc/a</Key><Size>1</Size></Contents></ListBucketResult>`))
+		case r.Method == http.MethodPost && query.Has("delete"):
+			removed.Add(1)
+			_, _ = w.Write([]byte(`<DeleteResult></DeleteResult>`))
+		case r.Method == http.MethodDelete:
+			removed.Add(1)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL)
+	if err := client.RemovePrefix("csi-fs/pvc"); err == nil {
+		t.Errorf("RemovePrefix succeeded after removing %d batches, expected the listing error", removed.Load())
+	}
+}
+
+func TestListMetadata(t *testing.T) {
+	objects := map[string]string{
+		".csi-meta/csi-fs/pvc-a.json": `{"driverName":"bucket","fsPathPrefix":"csi-fs/pvc-a","volumeId":"v1::bucket:csi-fs/pvc-a:"}`,
+		// The metadata naming another prefix is ignored.
+		".csi-meta/csi-fs/pvc-b.json": `{"driverName":"bucket","fsPathPrefix":"csi-fs/pvc-a","volumeId":"v1::bucket:csi-fs/pvc-b:"}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.URL.Query().Has("list-type"):
+			if prefix := r.URL.Query().Get("prefix"); prefix != MetadataPrefix+"/" {
+				t.Errorf("listed objects under %q", prefix)
+			}
+			contents := ""
+			for key := range objects {
+				contents += "<Contents><Key>" + key + "</Key><Size>1</Size></Contents>"
+			}
+			_, _ = w.Write([]byte("<ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>" + contents + "</ListBucketResult>"))
+		case len(objects[key]) != 0:
+			w.Header().Set("Last-Modified", "Mon, 2 Jan 2006 15:04:05 GMT")
+			_, _ = w.Write([]byte(objects[key]))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+		}
+	}))
+	defer server.Close()
+
+	metadataList, err := newTestClient(t, server.URL).ListMetadata()
+	if err != nil {
+		t.Fatalf("ListMetadata failed: %v", err)
+	}
+	if len(metadataList) != 1 || metadataList[0].FsPathPrefix != "csi-fs/pvc-a" {
+		t.Errorf("ListMetadata() = %+v, expected the metadata of csi-fs/pvc-a", metadataList)
+	}
+}
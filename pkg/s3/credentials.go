@@ -0,0 +1,291 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// Providers of the credentials. The static one takes the keys of the secrets,
+// while the others fetch temporary credentials, which are refreshed once they
+// expire.
+const (
+	CredentialProviderStatic = "static"
+	// CredentialProviderEnv takes the keys of the environment of the driver.
+	CredentialProviderEnv = "env"
+	// CredentialProviderFile takes the keys of the files of a directory, e.g. a
+	// Secret mounted into the driver, which are read again once they change.
+	CredentialProviderFile = "file"
+	// CredentialProviderIMDS takes the role of the instance from its metadata.
+	CredentialProviderIMDS = "imds"
+	// CredentialProviderWebIdentity exchanges the token of the service account
+	// for the role, e.g. IRSA or MinIO `AssumeRoleWithWebIdentity`.
+	CredentialProviderWebIdentity = "webIdentity"
+	// CredentialProviderAssumeRole assumes the role with the static keys.
+	CredentialProviderAssumeRole = "assumeRole"
+	// CredentialProviderLDAP exchanges the LDAP account with MinIO STS.
+	CredentialProviderLDAP = "ldap"
+)
+
+// CredentialsConfig selects where the credentials come from.
+type CredentialsConfig struct {
+	// Provider is the static one if empty.
+	Provider string
+	// Path is the directory of the file provider, holding the files
+	// `accessKeyID`, `secretAccessKey` and the optional `sessionToken`.
+	Path            string
+	RoleARN         string
+	RoleSessionName string
+	ExternalID      string
+	// STSEndpoint is the endpoint of STS, see Config.STSEndpoint.
+	STSEndpoint string
+	// WebIdentityTokenFile defaults to `AWS_WEB_IDENTITY_TOKEN_FILE`, which is
+	// set by IRSA, like the role does to `AWS_ROLE_ARN`.
+	WebIdentityTokenFile string
+	LDAPUsername         string
+	LDAPPassword         string
+}
+
+// credentialsFromEnv fills the settings of web identity left empty from the
+// environment of the driver.
+func (config *CredentialsConfig) credentialsFromEnv() {
+	if config.Provider != CredentialProviderWebIdentity {
+		return
+	}
+	if len(config.WebIdentityTokenFile) == 0 {
+		config.WebIdentityTokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if len(config.RoleARN) == 0 {
+		config.RoleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	if len(config.RoleSessionName) == 0 {
+		config.RoleSessionName = os.Getenv("AWS_ROLE_SESSION_NAME")
+	}
+}
+
+// validateCredentials validates that the provider is known and given what it
+// requires.
+func (config *Config) validateCredentials() error {
+	if len(config.SessionToken) != 0 && !config.Credentials.UsesKeys() {
+		return fmt.Errorf("credential provider %s takes no session token", config.Credentials.Provider)
+	}
+	switch config.Credentials.Provider {
+	case "", CredentialProviderStatic, CredentialProviderEnv, CredentialProviderIMDS:
+	case CredentialProviderFile:
+		if len(config.Credentials.Path) == 0 {
+			return errors.New("credential provider file requires the path of the credentials")
+		}
+	case CredentialProviderWebIdentity:
+		if len(config.Credentials.WebIdentityTokenFile) == 0 {
+			return errors.New("credential provider webIdentity requires a token file")
+		}
+	case CredentialProviderAssumeRole:
+		if len(config.AccessKeyID) == 0 || len(config.SecretAccessKey) == 0 {
+			return errors.New("credential provider assumeRole requires the keys to assume the role with")
+		}
+		if len(config.Credentials.RoleARN) == 0 {
+			return errors.New("credential provider assumeRole requires a role ARN")
+		}
+	case CredentialProviderLDAP:
+		if len(config.Credentials.LDAPUsername) == 0 || len(config.Credentials.LDAPPassword) == 0 {
+			return errors.New("credential provider ldap requires the LDAP username and password")
+		}
+	default:
+		return fmt.Errorf("unknown credential provider %s, expected one of %s", config.Credentials.Provider,
+			strings.Join([]string{CredentialProviderStatic, CredentialProviderEnv, CredentialProviderFile, CredentialProviderIMDS,
+				CredentialProviderWebIdentity, CredentialProviderAssumeRole, CredentialProviderLDAP}, ", "))
+	}
+	return nil
+}
+
+// IsAmbientProvider reports whether the provider takes the credentials of the
+// driver or of its node, e.g. its environment, instance role or service account
+// token, rather than the ones it is given.
+func IsAmbientProvider(provider string) bool {
+	switch provider {
+	case CredentialProviderEnv, CredentialProviderIMDS, CredentialProviderFile, CredentialProviderWebIdentity:
+		return true
+	}
+	return false
+}
+
+// UsesKeys reports whether the keys of the config are used as they are, rather
+// than to fetch temporary credentials. They may be rotated while the volume is
+// mounted.
+func (config CredentialsConfig) UsesKeys() bool {
+	switch config.Provider {
+	case "", CredentialProviderStatic, CredentialProviderEnv, CredentialProviderFile:
+		return true
+	}
+	return false
+}
+
+// IsAWS reports whether the endpoint is the one of AWS S3.
+func (config *Config) IsAWS() bool {
+	endpoint, err := url.Parse(config.Endpoint)
+	return err == nil && s3utils.IsAmazonEndpoint(*endpoint)
+}
+
+// STSEndpoint returns the endpoint of STS. It defaults to the AWS STS of the
+// region for AWS S3, and to the S3 endpoint otherwise, where MinIO serves STS.
+func (config *Config) STSEndpoint() string {
+	switch {
+	case len(config.Credentials.STSEndpoint) != 0:
+		return config.Credentials.STSEndpoint
+	case !config.IsAWS():
+		return config.Endpoint
+	case len(config.Region) == 0:
+		return "https://sts.amazonaws.com"
+	case strings.HasPrefix(config.Region, "cn-"):
+		return "https://sts." + config.Region + ".amazonaws.com.cn"
+	}
+	return "https://sts." + config.Region + ".amazonaws.com"
+}
+
+// UsesAWSSTS reports whether the temporary credentials are fetched from the
+// AWS STS picked by the AWS SDKs, which the mounters built on them rely on.
+func (config *Config) UsesAWSSTS() bool {
+	return len(config.Credentials.STSEndpoint) == 0 && config.IsAWS()
+}
+
+// credentials builds the credentials of the S3 client. The STS requests are
+// sent by the client, so that they honor the TLS settings of the endpoint.
+func (config *Config) credentials(client *http.Client) *credentials.Credentials {
+	switch config.Credentials.Provider {
+	case CredentialProviderIMDS:
+		return credentials.New(&credentials.IAM{Client: client})
+	case CredentialProviderWebIdentity:
+		tokenFile := config.Credentials.WebIdentityTokenFile
+		return credentials.New(&credentials.STSWebIdentity{
+			Client:      client,
+			STSEndpoint: config.STSEndpoint(),
+			RoleARN:     config.Credentials.RoleARN,
+			// The token is read on every refresh, as the kubelet rotates it.
+			GetWebIDTokenExpiry: func() (*credentials.WebIdentityToken, error) {
+				token, err := os.ReadFile(tokenFile)
+				if err != nil {
+					return nil, err
+				}
+				return &credentials.WebIdentityToken{Token: strings.TrimSpace(string(token))}, nil
+			},
+		})
+	case CredentialProviderAssumeRole:
+		return credentials.New(&credentials.STSAssumeRole{
+			Client:      client,
+			STSEndpoint: config.STSEndpoint(),
+			Options: credentials.STSAssumeRoleOptions{
+				AccessKey:       config.AccessKeyID,
+				SecretKey:       config.SecretAccessKey,
+				Location:        config.Region,
+				RoleARN:         config.Credentials.RoleARN,
+				RoleSessionName: config.Credentials.RoleSessionName,
+				ExternalID:      config.Credentials.ExternalID,
+			},
+		})
+	case CredentialProviderLDAP:
+		return credentials.New(&credentials.LDAPIdentity{
+			Client:       client,
+			STSEndpoint:  config.STSEndpoint(),
+			LDAPUsername: config.Credentials.LDAPUsername,
+			LDAPPassword: config.Credentials.LDAPPassword,
+		})
+	}
+	// The keys of the env and file providers are already read.
+	return credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, config.SessionToken)
+}
+
+// FetchedConfig returns a copy of the config holding the keys fetched by the
+// provider as static ones, for the mounters unable to fetch them by themselves,
+// e.g. from MinIO STS. The temporary keys are fetched again before they expire.
+func (client *S3Client) FetchedConfig() (*Config, error) {
+	value, err := client.creds.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch credentials of provider %s: %w", client.Config.Credentials.Provider, err)
+	}
+	config := *client.Config
+	config.AccessKeyID, config.SecretAccessKey, config.SessionToken = value.AccessKeyID, value.SecretAccessKey, value.SessionToken
+	config.Credentials = CredentialsConfig{Provider: CredentialProviderStatic}
+	return &config, nil
+}
+
+// SessionTokenExpiry returns the expiry of the session token, which MinIO STS
+// issues as a JWT. The tokens of AWS STS are opaque, so theirs is unknown.
+func SessionTokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// readCredentials fills the keys of the env and file providers.
+func (config *Config) readCredentials() error {
+	var err error
+	switch config.Credentials.Provider {
+	case CredentialProviderEnv:
+		config.AccessKeyID, config.SecretAccessKey, config.SessionToken, err = envCredentials()
+	case CredentialProviderFile:
+		if len(config.Credentials.Path) != 0 {
+			config.AccessKeyID, config.SecretAccessKey, config.SessionToken, err = fileCredentials(config.Credentials.Path)
+		}
+	}
+	return err
+}
+
+// envCredentials returns the keys of the environment of the driver, either
+// the AWS or the MinIO ones.
+func envCredentials() (string, string, string, error) {
+	value, err := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+	}).Get()
+	if err != nil {
+		return "", "", "", err
+	}
+	if len(value.AccessKeyID) == 0 {
+		return "", "", "", errors.New("no credentials found in the environment")
+	}
+	return value.AccessKeyID, value.SecretAccessKey, value.SessionToken, nil
+}
+
+// fileCredentials returns the keys of the files of the directory. kubelet
+// swaps the files of a mounted Secret at once, so the keys read match.
+func fileCredentials(dir string) (string, string, string, error) {
+	values := make([]string, 3)
+	for i, name := range []string{"accessKeyID", "secretAccessKey", constant.SessionTokenKey} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			// The session token is optional.
+			if os.IsNotExist(err) && name == constant.SessionTokenKey {
+				continue
+			}
+			return "", "", "", fmt.Errorf("failed to read credentials: %w", err)
+		}
+		values[i] = strings.TrimSpace(string(content))
+	}
+	if len(values[0]) == 0 || len(values[1]) == 0 {
+		return "", "", "", fmt.Errorf("no credentials found in %s", dir)
+	}
+	return values[0], values[1], values[2], nil
+}
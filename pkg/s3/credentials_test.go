@@ -0,0 +1,103 @@
+package s3
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+)
+
+func TestSTSEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint    string
+		region      string
+		stsEndpoint string
+		expected    string
+	}{
+		{"http://127.0.0.1:9000", "", "", "http://127.0.0.1:9000"},
+		{"https://s3.amazonaws.com", "", "", "https://sts.amazonaws.com"},
+		{"https://s3.eu-west-1.amazonaws.com", "eu-west-1", "", "https://sts.eu-west-1.amazonaws.com"},
+		{"https://s3.cn-north-1.amazonaws.com.cn", "cn-north-1", "", "https://sts.cn-north-1.amazonaws.com.cn"},
+		{"https://s3.amazonaws.com", "", "https://sts.example.com", "https://sts.example.com"},
+	}
+	for _, c := range cases {
+		config := &Config{Endpoint: c.endpoint, Region: c.region, Credentials: CredentialsConfig{STSEndpoint: c.stsEndpoint}}
+		if endpoint := config.STSEndpoint(); endpoint != c.expected {
+			t.Errorf("STSEndpoint() of %+v = %s, expected %s", config, endpoint, c.expected)
+		}
+	}
+}
+
+func TestSessionTokenExpiry(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"accessKey":"key","exp":4102444800}`))
+	cases := []struct {
+		token    string
+		expected time.Time
+		ok       bool
+	}{
+		{"eyJhbGciOiJIUzUxMiJ9." + payload + ".signature", time.Unix(4102444800, 0), true},
+		{"eyJhbGciOiJIUzUxMiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"accessKey":"key"}`)) + ".signature", time.Time{}, false},
+		{"FwoGZXIvYXdzEBYaDH0pWx/opaque+token==", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, c := range cases {
+		if expiry, ok := SessionTokenExpiry(c.token); ok != c.ok || !expiry.Equal(c.expected) {
+			t.Errorf("SessionTokenExpiry(%s) = %s, %v, expected %s, %v", c.token, expiry, ok, c.expected, c.ok)
+		}
+	}
+}
+
+func TestInvalidCredentialSecrets(t *testing.T) {
+	cases := []struct {
+		name    string
+		secrets map[string]string
+	}{
+		{"unknown provider", map[string]string{constant.CredentialProviderKey: "vault"}},
+		{"assumeRole without keys", map[string]string{constant.CredentialProviderKey: CredentialProviderAssumeRole, constant.RoleARNKey: "role"}},
+		{"assumeRole without role", map[string]string{constant.CredentialProviderKey: CredentialProviderAssumeRole, "accessKeyID": "key", "secretAccessKey": "secret"}},
+		{"ldap without password", map[string]string{constant.CredentialProviderKey: CredentialProviderLDAP, constant.LDAPUsernameKey: "user"}},
+		{"file without path", map[string]string{constant.CredentialProviderKey: CredentialProviderFile}},
+		{"file without keys", map[string]string{constant.CredentialProviderKey: CredentialProviderFile, constant.CredentialsPathKey: "/nonexistent"}},
+		{"session token of imds", map[string]string{constant.CredentialProviderKey: CredentialProviderIMDS, constant.SessionTokenKey: "token"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ConfigFromSecrets(c.secrets); err == nil {
+				t.Errorf("ConfigFromSecrets(%v) succeeded, expected an error", c.secrets)
+			}
+		})
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	dir := t.TempDir()
+	write := func(files map[string]string) {
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	secrets := map[string]string{constant.CredentialProviderKey: CredentialProviderFile, constant.CredentialsPathKey: dir}
+
+	write(map[string]string{"accessKeyID": "key\n", "secretAccessKey": "secret\n"})
+	config, err := ConfigFromSecrets(secrets)
+	if err != nil {
+		t.Fatalf("ConfigFromSecrets failed: %v", err)
+	}
+	if config.AccessKeyID != "key" || config.SecretAccessKey != "secret" || config.SessionToken != "" {
+		t.Errorf("keys = %s, %s, %s, expected key, secret and no session token", config.AccessKeyID, config.SecretAccessKey, config.SessionToken)
+	}
+
+	// The rotated keys are read again.
+	write(map[string]string{"accessKeyID": "rotated-key", "secretAccessKey": "rotated-secret", constant.SessionTokenKey: "token"})
+	if config, err = ConfigFromSecrets(secrets); err != nil {
+		t.Fatalf("ConfigFromSecrets failed: %v", err)
+	}
+	if config.AccessKeyID != "rotated-key" || config.SecretAccessKey != "rotated-secret" || config.SessionToken != "token" {
+		t.Errorf("keys = %s, %s, %s, expected the rotated ones", config.AccessKeyID, config.SecretAccessKey, config.SessionToken)
+	}
+}
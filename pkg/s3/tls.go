@@ -0,0 +1,66 @@
+package s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// TLSConfig holds the TLS settings of the endpoint. The PEM blocks are kept as
+// given, so that the mounters are handed the very same files.
+type TLSConfig struct {
+	// CABundle is the PEM of the CAs trusted instead of the system ones.
+	CABundle string
+	// InsecureSkipVerify skips the verification of the server certificate.
+	InsecureSkipVerify bool
+	// ClientCert and ClientKey are the PEM of the client certificate.
+	ClientCert string
+	ClientKey  string
+}
+
+// IsDefault reports whether the endpoint is reached with the system CAs and
+// without any client certificate.
+func (config *TLSConfig) IsDefault() bool {
+	return len(config.CABundle) == 0 && !config.InsecureSkipVerify && len(config.ClientCert) == 0
+}
+
+// parseBool parses the boolean secret, where the empty one is false.
+func parseBool(key string, value string) (bool, error) {
+	if len(value) == 0 {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false: %s", key, value)
+	}
+	return b, nil
+}
+
+// clientConfig builds the TLS configuration of the S3 client, which is nil for
+// the default one.
+func (config *TLSConfig) clientConfig() (*tls.Config, error) {
+	if config.IsDefault() && len(config.ClientKey) == 0 {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if len(config.CABundle) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.CABundle)) {
+			return nil, errors.New("CA bundle contains no PEM certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(config.ClientCert) != 0 || len(config.ClientKey) != 0 {
+		certificate, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,59 @@
+package s3
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leryn1122/csi-s3/pkg/constant"
+)
+
+func TestTLSConfig(t *testing.T) {
+	// The endpoint answers every request, so that the bucket exists once the
+	// TLS handshake succeeds.
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	caBundle := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	cases := []struct {
+		name     string
+		tls      TLSConfig
+		expected bool
+	}{
+		{"system CAs", TLSConfig{}, false},
+		{"CA bundle", TLSConfig{CABundle: caBundle}, true},
+		{"insecure", TLSConfig{InsecureSkipVerify: true}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := newS3Client(&Config{Endpoint: server.URL, Region: "us-east-1", Bucket: "bucket", AddressingStyle: AddressingStylePath, TLS: c.tls})
+			if err != nil {
+				t.Fatalf("newS3Client failed: %v", err)
+			}
+			_, err = client.BucketExists()
+			if succeeded := err == nil; succeeded != c.expected {
+				t.Errorf("BucketExists() error = %v, expected success %v", err, c.expected)
+			}
+		})
+	}
+}
+
+func TestInvalidTLSSecrets(t *testing.T) {
+	cases := []struct {
+		name    string
+		secrets map[string]string
+	}{
+		{"CA bundle without certificate", map[string]string{constant.CABundleKey: "not a PEM"}},
+		{"client key without certificate", map[string]string{constant.TLSClientKeyKey: "key"}},
+		{"invalid client certificate", map[string]string{constant.TLSClientCertKey: "cert", constant.TLSClientKeyKey: "key"}},
+		{"insecureSkipVerify not a boolean", map[string]string{constant.InsecureSkipVerifyKey: "yes please"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ConfigFromSecrets(c.secrets); err == nil {
+				t.Errorf("ConfigFromSecrets(%v) succeeded, expected an error", c.secrets)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Version1 is the current version of the volume ID format.
+const Version1 = "v1"
+
+// MaxLength is the maximum length of the volume ID allowed by CSI.
+const MaxLength = 128
+
+const separator = ":"
+
+// ID locates the data of a volume without any other state.
+//
+// The v1 format is `v1:<mounter>:<bucket>:<prefix>:<name>`, where the name is
+// only kept for the volumes of the whole bucket, since the bucket and the
+// prefix are unique otherwise.
+//
+// IDs without a version are legacy ones, either `<bucket>/<prefix>` or the
+// plain volume name whose bucket is given by the secrets.
+type ID struct {
+	Version string
+	Mounter string
+	Bucket  string
+	Prefix  string
+	Name    string
+}
+
+// New creates a v1 volume ID.
+func New(mounter string, bucket string, prefix string, name string) (*ID, error) {
+	id := &ID{
+		Version: Version1,
+		Mounter: mounter,
+		Bucket:  bucket,
+		Prefix:  prefix,
+	}
+	if len(prefix) == 0 {
+		id.Name = name
+	}
+	for _, field := range []string{id.Mounter, id.Bucket, id.Prefix, id.Name} {
+		if strings.Contains(field, separator) {
+			return nil, fmt.Errorf("volume ID field `%s` must not contain `%s`", field, separator)
+		}
+	}
+	if len(id.Bucket) == 0 {
+		return nil, errors.New("volume ID must contain the bucket")
+	}
+	if length := len(id.String()); length > MaxLength {
+		return nil, fmt.Errorf("volume ID %s exceeds %d characters", id, MaxLength)
+	}
+	return id, nil
+}
+
+// Parse decodes the volume ID in any known format.
+func Parse(volumeId string) (*ID, error) {
+	if len(volumeId) == 0 {
+		return nil, errors.New("volume ID is empty")
+	}
+	if !strings.Contains(volumeId, separator) {
+		return parseLegacy(volumeId), nil
+	}
+
+	fields := strings.Split(volumeId, separator)
+	switch fields[0] {
+	case Version1:
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("malformed %s volume ID: %s", Version1, volumeId)
+		}
+		id := &ID{
+			Version: fields[0],
+			Mounter: fields[1],
+			Bucket:  fields[2],
+			Prefix:  fields[3],
+			Name:    fields[4],
+		}
+		if len(id.Bucket) == 0 {
+			return nil, fmt.Errorf("malformed %s volume ID without bucket: %s", Version1, volumeId)
+		}
+		return id, nil
+	default:
+		return nil, fmt.Errorf("unknown version of volume ID: %s", volumeId)
+	}
+}
+
+func parseLegacy(volumeId string) *ID {
+	bucket, prefix, found := strings.Cut(volumeId, "/")
+	if !found {
+		return &ID{Name: volumeId}
+	}
+	return &ID{Bucket: bucket, Prefix: prefix}
+}
+
+// IsLegacy reports whether the bucket of the volume is given by the secrets.
+func (id *ID) IsLegacy() bool {
+	return len(id.Version) == 0
+}
+
+func (id *ID) String() string {
+	if id.IsLegacy() {
+		if len(id.Bucket) == 0 {
+			return id.Name
+		}
+		return id.Bucket + "/" + id.Prefix
+	}
+	return strings.Join([]string{id.Version, id.Mounter, id.Bucket, id.Prefix, id.Name}, separator)
+}
@@ -0,0 +1,63 @@
+package volume
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]*ID{
+		"v1:s3fs:test::pvc-1":              {Version: Version1, Mounter: "s3fs", Bucket: "test", Name: "pvc-1"},
+		"v1:rclone:test:csi-fs/pvc-1:":     {Version: Version1, Mounter: "rclone", Bucket: "test", Prefix: "csi-fs/pvc-1"},
+		"v1::default-pvc-1::":              {Version: Version1, Bucket: "default-pvc-1"},
+		"test/csi-fs/pvc-1":                {Bucket: "test", Prefix: "csi-fs/pvc-1"},
+		"pvc-1":                            {Name: "pvc-1"},
+		"":                                 nil,
+		"v1:s3fs:test:csi-fs/pvc-1":        nil,
+		"v1:s3fs::csi-fs/pvc-1:":           nil,
+		"v2:s3fs:test:csi-fs/pvc-1:pvc-1:": nil,
+	}
+	for volumeId, expected := range cases {
+		id, err := Parse(volumeId)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("Parse(%q) = %v, expected error", volumeId, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", volumeId, err)
+			continue
+		}
+		if !reflect.DeepEqual(id, expected) {
+			t.Errorf("Parse(%q) = %#v, expected %#v", volumeId, id, expected)
+		}
+		if id.String() != volumeId {
+			t.Errorf("Parse(%q).String() = %q", volumeId, id.String())
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	id, err := New("s3fs", "test", "csi-fs/pvc-1", "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.String() != "v1:s3fs:test:csi-fs/pvc-1:" {
+		t.Errorf("unexpected volume ID: %s", id)
+	}
+
+	if _, err = New("s3fs", "test", "csi-fs:pvc-1", "pvc-1"); err == nil {
+		t.Error("expected error for prefix with separator")
+	}
+	if _, err = New("s3fs", "", "", "pvc-1"); err == nil {
+		t.Error("expected error without bucket")
+	}
+	long := make([]byte, MaxLength)
+	for i := range long {
+		long[i] = 'a'
+	}
+	if _, err = New("s3fs", "test", string(long), "pvc-1"); err == nil {
+		t.Error("expected error for too long volume ID")
+	}
+}